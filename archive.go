@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// archiveBodyLimit caps how much of a response body is kept for the archive; larger bodies are left out of it.
+const archiveBodyLimit = 4 << 20
+
+// Archive holds forwarded exchanges in HAR format, either being recorded from the upstream, or being replayed in
+// its place.
+type Archive struct {
+	mu    sync.Mutex
+	file  string
+	har   harFile
+	used  map[int]int // how many times each entry has been replayed
+	match map[string]bool
+	out   *os.File // the recording, once it has been created
+	end   int64    // where harTrailer starts in out
+	count int      // entries written to out
+}
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	Started  time.Time   `json:"startedDateTime"`
+	Time     float64     `json:"time"`
+	Request  harRequest  `json:"request"`
+	Response harResponse `json:"response"`
+	Cache    struct{}    `json:"cache"`
+	Timings  harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []harPair    `json:"cookies"`
+	Headers     []harPair    `json:"headers"`
+	QueryString []harPair    `json:"queryString"`
+	PostData    *harPostData `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"` // not in HAR 1.2, but needed for binary bodies.
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Cookies     []harPair  `json:"cookies"`
+	Headers     []harPair  `json:"headers"`
+	Content     harContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int        `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harPair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// archiveMatches lists what may be compared when looking for a recorded response to replay.
+var archiveMatches = []string{"host", "method", "path", "query", "body"}
+
+// OpenArchive loads the HAR file at file, if it exists.  Requests are matched on the comma separated fields in
+// match when replaying.
+func OpenArchive(file, match string) (*Archive, error) {
+	ar := &Archive{file: file, used: make(map[int]int), match: make(map[string]bool)}
+	for _, m := range strings.Split(match, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		ok := false
+		for _, am := range archiveMatches {
+			ok = ok || m == am
+		}
+		if !ok {
+			return nil, fmt.Errorf(`cannot match recorded requests on %#v, expected some of %v`, m, strings.Join(archiveMatches, ","))
+		}
+		ar.match[m] = true
+	}
+
+	ar.har.Log.Version = "1.2"
+	ar.har.Log.Creator = harCreator{"livefire", "1"}
+	data, err := ioutil.ReadFile(file)
+	switch {
+	case os.IsNotExist(err):
+		return ar, nil
+	case err != nil:
+		return nil, err
+	}
+	err = json.Unmarshal(data, &ar.har)
+	if err != nil {
+		return nil, fmt.Errorf(`%v: %v`, file, err)
+	}
+	return ar, nil
+}
+
+// Record relays req using next, adding the exchange to the archive once the response body has been read.
+func (ar *Archive) Record(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		reqBody, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	started := time.Now()
+	rsp, err := next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	waited := time.Now()
+
+	entry := harEntry{Started: started, Request: newHarRequest(req, reqBody)}
+	save := func(rspBody []byte, comment string) {
+		done := time.Now()
+		entry.Response = newHarResponse(rsp, rspBody)
+		entry.Response.Content.Comment = comment
+		entry.Timings = harTimings{Wait: msBetween(started, waited), Receive: msBetween(waited, done)}
+		entry.Time = msBetween(started, done)
+		ar.add(entry)
+	}
+	switch {
+	case rsp.StatusCode == http.StatusSwitchingProtocols || rsp.Body == nil:
+		save(nil, "")
+	case isStream(rsp.Header.Get("Content-Type")):
+		save(nil, "livefire does not record streamed bodies") // they may never end.
+	case rsp.ContentLength > archiveBodyLimit:
+		save(nil, tooBigToRecord)
+	default:
+		rsp.Body = &recordBody{ReadCloser: rsp.Body, save: save}
+	}
+	return rsp, nil
+}
+
+var tooBigToRecord = fmt.Sprintf("livefire does not record bodies over %v bytes", archiveBodyLimit)
+
+// isStream reports whether contentType is one that servers use for responses that go on indefinitely.
+func isStream(contentType string) bool {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	return mt == "text/event-stream" || mt == "multipart/x-mixed-replace"
+}
+
+func (ar *Archive) add(entry harEntry) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	err := ar.append(entry)
+	if err != nil {
+		reportError("recording "+ar.file, err)
+	}
+}
+
+// The archive is written as harHeader, the entries, then harTrailer, which is overwritten by each entry added, so
+// the file is always a valid HAR file without rewriting what was already recorded.
+const (
+	harHeader  = "{\"log\": {\n  \"version\": \"1.2\",\n  \"creator\": {\"name\": \"livefire\", \"version\": \"1\"},\n  \"entries\": ["
+	harTrailer = "\n  ]\n}}\n"
+)
+
+// append adds entry to the end of the recording, creating it first if need be; ar.mu must be held.
+func (ar *Archive) append(entry harEntry) error {
+	if ar.out == nil {
+		err := ar.create()
+		if err != nil {
+			return err
+		}
+	}
+	data, err := ar.marshalEntry(&entry)
+	if err != nil {
+		return err
+	}
+	_, err = ar.out.WriteAt(append(data, harTrailer...), ar.end)
+	if err != nil {
+		return err
+	}
+	ar.end += int64(len(data))
+	ar.count++
+	return nil
+}
+
+// marshalEntry formats an entry to follow the ones already written; ar.mu must be held.
+func (ar *Archive) marshalEntry(entry *harEntry) ([]byte, error) {
+	data, err := json.MarshalIndent(entry, "    ", "  ")
+	if err != nil {
+		return nil, err
+	}
+	sep := ",\n    "
+	if ar.count == 0 {
+		sep = "\n    "
+	}
+	return append([]byte(sep), data...), nil
+}
+
+// create replaces the archive with one holding the entries loaded by OpenArchive, and keeps it open for append;
+// ar.mu must be held.
+func (ar *Archive) create() error {
+	buf := bytes.NewBufferString(harHeader)
+	for i := range ar.har.Log.Entries {
+		data, err := ar.marshalEntry(&ar.har.Log.Entries[i])
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		ar.count++
+	}
+	end := int64(buf.Len())
+	buf.WriteString(harTrailer)
+	ar.har.Log.Entries = nil // they are in the file now, and recording never looks at them again.
+
+	tmp, err := ioutil.TempFile(filepath.Dir(ar.file), ".livefire-har")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = os.Rename(tmp.Name(), ar.file)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	ar.out, ar.end = tmp, end
+	return nil
+}
+
+// Close closes the recording, if one was created.
+func (ar *Archive) Close() error {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	if ar.out == nil {
+		return nil
+	}
+	err := ar.out.Close()
+	ar.out = nil
+	return err
+}
+
+// recordBody buffers a response body as it is relayed, saving it once it has been read or closed.  A body that
+// grows past archiveBodyLimit is saved without its content as soon as it does, since it may never end.
+type recordBody struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	over  bool
+	save  func(body []byte, comment string)
+	saved sync.Once
+}
+
+func (rb *recordBody) Read(p []byte) (int, error) {
+	n, err := rb.ReadCloser.Read(p)
+	switch {
+	case rb.over:
+	case rb.buf.Len()+n > archiveBodyLimit:
+		rb.over = true
+		rb.buf = bytes.Buffer{}
+		rb.saved.Do(func() { rb.save(nil, tooBigToRecord) })
+	default:
+		rb.buf.Write(p[:n])
+	}
+	if err == io.EOF {
+		rb.saved.Do(func() { rb.save(rb.buf.Bytes(), "") })
+	}
+	return n, err
+}
+
+func (rb *recordBody) Close() error {
+	err := rb.ReadCloser.Close()
+	rb.saved.Do(func() { rb.save(rb.buf.Bytes(), "") })
+	return err
+}
+
+// Replay answers req from the archive.  When several entries match, they are replayed in the order they were
+// recorded, and the last one is repeated once they run out.
+func (ar *Archive) Replay(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if ar.match["body"] && req.Body != nil && req.Body != http.NoBody {
+		var err error
+		reqBody, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ar.mu.Lock()
+	found, last := -1, -1
+	for i := range ar.har.Log.Entries {
+		if !ar.matches(&ar.har.Log.Entries[i].Request, req, reqBody) {
+			continue
+		}
+		last = i
+		if found < 0 && ar.used[i] == 0 {
+			found = i
+		}
+	}
+	if found < 0 {
+		found = last
+	}
+	var entry harEntry
+	if found >= 0 {
+		ar.used[found]++
+		entry = ar.har.Log.Entries[found]
+	}
+	ar.mu.Unlock()
+
+	if found < 0 {
+		log.Printf("no recorded response for %v %v", req.Method, req.URL.String())
+		body := "no recorded response for " + req.Method + " " + req.URL.String() + "\n"
+		return &http.Response{
+			Status:        "404 Not Found",
+			StatusCode:    404,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+			Body:          ioutil.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	log.Printf("replaying %v %v", req.Method, req.URL.String())
+	return entry.Response.toResponse(req)
+}
+
+func (ar *Archive) matches(hr *harRequest, req *http.Request, body []byte) bool {
+	if ar.match["method"] && hr.Method != req.Method {
+		return false
+	}
+	u, err := url.Parse(hr.URL)
+	if err != nil {
+		return false
+	}
+	if ar.match["host"] && !strings.EqualFold(u.Host, req.URL.Host) {
+		return false // several forwards may send the same path to different upstreams.
+	}
+	if ar.match["path"] && u.Path != req.URL.Path {
+		return false
+	}
+	if ar.match["query"] && u.Query().Encode() != req.URL.Query().Encode() {
+		return false
+	}
+	if ar.match["body"] {
+		var recorded []byte
+		if hr.PostData != nil {
+			recorded, _ = decodeHarText(hr.PostData.Text, hr.PostData.Encoding)
+		}
+		if !bytes.Equal(recorded, body) {
+			return false
+		}
+	}
+	return true
+}
+
+func newHarRequest(req *http.Request, body []byte) harRequest {
+	hr := harRequest{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: req.Proto,
+		Cookies:     []harPair{},
+		Headers:     harHeaders(req.Header),
+		QueryString: []harPair{},
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+	for k, vv := range req.URL.Query() {
+		for _, v := range vv {
+			hr.QueryString = append(hr.QueryString, harPair{k, v})
+		}
+	}
+	if body != nil {
+		text, encoding := encodeHarText(body)
+		hr.PostData = &harPostData{MimeType: req.Header.Get("Content-Type"), Text: text, Encoding: encoding}
+	}
+	return hr
+}
+
+func newHarResponse(rsp *http.Response, body []byte) harResponse {
+	text, encoding := encodeHarText(body)
+	return harResponse{
+		Status:      rsp.StatusCode,
+		StatusText:  http.StatusText(rsp.StatusCode),
+		HTTPVersion: rsp.Proto,
+		Cookies:     []harPair{},
+		Headers:     harHeaders(rsp.Header),
+		Content: harContent{
+			Size:     len(body),
+			MimeType: rsp.Header.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+		},
+		RedirectURL: rsp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+}
+
+func (hr *harResponse) toResponse(req *http.Request) (*http.Response, error) {
+	body, err := decodeHarText(hr.Content.Text, hr.Content.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	h := make(http.Header)
+	for _, p := range hr.Headers {
+		h.Add(p.Name, p.Value)
+	}
+	h.Del("Transfer-Encoding")
+	h.Set("Content-Length", fmt.Sprint(len(body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", hr.Status, hr.StatusText),
+		StatusCode:    hr.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+func harHeaders(h http.Header) []harPair {
+	pairs := []harPair{}
+	for k, vv := range h {
+		for _, v := range vv {
+			pairs = append(pairs, harPair{k, v})
+		}
+	}
+	return pairs
+}
+
+func encodeHarText(data []byte) (string, string) {
+	if utf8.Valid(data) {
+		return string(data), ""
+	}
+	return base64.StdEncoding.EncodeToString(data), "base64"
+}
+
+func decodeHarText(text, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return []byte(text), nil
+}
+
+func msBetween(a, b time.Time) float64 {
+	return float64(b.Sub(a)) / float64(time.Millisecond)
+}
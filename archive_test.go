@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (fn roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return fn(req) }
+
+// upstreamBody answers every request with a 200 carrying body, which is of unknown length if length is -1.
+func upstreamBody(contentType string, body io.Reader, length int64) roundTripFunc {
+	return func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode:    200,
+			Proto:         "HTTP/1.1",
+			Header:        http.Header{"Content-Type": {contentType}},
+			Body:          ioutil.NopCloser(body),
+			ContentLength: length,
+			Request:       req,
+		}, nil
+	}
+}
+
+func readHar(t *testing.T, file string) []harEntry {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var har harFile
+	err = json.Unmarshal(data, &har)
+	if err != nil {
+		t.Fatalf("%v: %s", err, data)
+	}
+	return har.Log.Entries
+}
+
+func TestArchiveRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livefire")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "session.har")
+	ar, err := OpenArchive(file, "method,path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := func(path string, next roundTripFunc) *http.Response {
+		req, _ := http.NewRequest("GET", "http://upstream"+path, nil)
+		rsp, err := ar.Record(req, next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp
+	}
+
+	for _, path := range []string{"/one", "/two"} {
+		rsp := record(path, upstreamBody("text/plain", strings.NewReader(path), -1))
+		ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+	}
+	entries := readHar(t, file)
+	if len(entries) != 2 || entries[1].Response.Content.Text != "/two" {
+		t.Fatalf("expected two entries, got %#v", entries)
+	}
+
+	// an event stream that never ends is recorded right away, without its body.
+	stream, w := io.Pipe()
+	defer w.Close()
+	record("/events", upstreamBody("text/event-stream; charset=utf-8", stream, -1))
+	entries = readHar(t, file)
+	if len(entries) != 3 || entries[2].Response.Content.Text != "" || entries[2].Response.Content.Comment == "" {
+		t.Fatalf("expected the stream to be recorded without its body, got %#v", entries[2:])
+	}
+
+	// so is a body of unknown length, once it grows past the limit.
+	rsp := record("/big", upstreamBody("application/octet-stream", io.MultiReader(
+		bytes.NewReader(make([]byte, archiveBodyLimit)), strings.NewReader("!"), stream,
+	), -1))
+	io.CopyN(ioutil.Discard, rsp.Body, archiveBodyLimit+1)
+	entries = readHar(t, file)
+	if len(entries) != 4 || entries[3].Response.Content.Text != "" || entries[3].Response.Content.Comment == "" {
+		t.Fatalf("expected the big body to be recorded without it, got %d entries", len(entries))
+	}
+	if err := ar.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// recording again keeps what was recorded before.
+	ar, err = OpenArchive(file, "method,path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp = record("/three", upstreamBody("text/plain", strings.NewReader("3"), 1))
+	ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	ar.Close()
+	entries = readHar(t, file)
+	if len(entries) != 5 || entries[0].Response.Content.Text != "/one" || entries[4].Response.Content.Text != "3" {
+		t.Fatalf("expected five entries, got %#v", entries)
+	}
+}
+
+func TestArchiveReplayMatchesHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "livefire")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "session.har")
+	ar, err := OpenArchive(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as from -r /api:strip=http://api:9000 and -r /auth:strip=http://auth:9000.
+	for _, host := range []string{"api:9000", "auth:9000"} {
+		req, _ := http.NewRequest("POST", "http://"+host+"/login", nil)
+		rsp, err := ar.Record(req, upstreamBody("text/plain", strings.NewReader(host), -1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+	}
+	ar.Close()
+
+	for _, c := range []struct {
+		match, host, expect string
+	}{
+		{"host,method,path,query", "auth:9000", "auth:9000"},
+		{"host,method,path,query", "api:9000", "api:9000"},
+		{"host,method,path,query", "AUTH:9000", "auth:9000"},
+		{"host,method,path,query", "localhost:9000", "no recorded response for POST http://localhost:9000/login\n"},
+		{"method,path,query", "localhost:9000", "api:9000"},
+	} {
+		ar, err := OpenArchive(file, c.match)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("POST", "http://"+c.host+"/login", nil)
+		rsp, err := ar.Replay(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(rsp.Body)
+		if string(body) != c.expect {
+			t.Errorf("%v with %v: got %q, expected %q", c.host, c.match, body, c.expect)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	tarantula "github.com/swdunlop/tarantula-go"
+)
+
+// authCookie carries the session token once a browser has used a login URL.
+const authCookie = "livefire-token"
+
+// loginTTL is how long a login URL works for, so one left on a screen or in a screenshot is soon useless.
+const loginTTL = 5 * time.Minute
+
+// Access describes who may use livefire: clients must come from an allowed network, and then present the session
+// token or the basic auth credentials, if either is required.
+type Access struct {
+	Token bool   // require the session token, handed out through login URLs
+	Basic string // require "user:password" through HTTP basic auth
+	Allow CIDRs  // networks clients may connect from; loopback is always allowed
+
+	mu      sync.Mutex
+	session string
+	logins  map[string]time.Time // unused login codes, and when they were minted
+}
+
+// CIDRs collects -allow options; it implements flag.Value.  Bare addresses are treated as single hosts.
+type CIDRs []*net.IPNet
+
+func (cs *CIDRs) String() string {
+	if cs == nil {
+		return ""
+	}
+	ss := make([]string, len(*cs))
+	for i, c := range *cs {
+		ss[i] = c.String()
+	}
+	return strings.Join(ss, ",")
+}
+
+func (cs *CIDRs) Set(arg string) error {
+	for _, s := range strings.Split(arg, ",") {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		*cs = append(*cs, n)
+	}
+	return nil
+}
+
+// Enabled reports whether any access control has been asked for.
+func (ac *Access) Enabled() bool {
+	return ac.Token || ac.Basic != "" || len(ac.Allow) > 0
+}
+
+// LoginURL mints a login code, and returns the path that trades it for the session cookie within loginTTL.  Codes
+// that have expired are forgotten.
+func (ac *Access) LoginURL() string {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.session == "" {
+		ac.session = randomToken()
+		ac.logins = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for code, minted := range ac.logins {
+		if now.Sub(minted) > loginTTL {
+			delete(ac.logins, code)
+		}
+	}
+	code := randomToken()
+	ac.logins[code] = now
+	return "/.livefire/login?code=" + code
+}
+
+func randomToken() string {
+	var buf [16]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// guard is installed with Server.Guard, turning away anyone who shouldn't be here.
+func (ac *Access) guard(req *http.Request) (interface{}, error) {
+	if !ac.allowed(req.RemoteAddr) {
+		return tarantula.HttpError{Code: 403, Msg: "not allowed from " + req.RemoteAddr}, nil
+	}
+	if ac.Basic != "" {
+		user, pass, ok := req.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user+":"+pass), []byte(ac.Basic)) != 1 {
+			return tarantula.WithHeader{
+				Key:  "WWW-Authenticate",
+				Val:  `Basic realm="livefire"`,
+				Next: tarantula.HttpError{Code: 401, Msg: "authentication required"},
+			}, nil
+		}
+	}
+	if ac.Token {
+		if req.URL.Path == "/.livefire/login" {
+			return ac.login(req)
+		}
+		c, err := req.Cookie(authCookie)
+		ac.mu.Lock()
+		ok := err == nil && subtle.ConstantTimeCompare([]byte(c.Value), []byte(ac.session)) == 1
+		ac.mu.Unlock()
+		if !ok {
+			return tarantula.HttpError{Code: 401, Msg: "log in with the URL livefire printed"}, nil
+		}
+	}
+	return nil, nil
+}
+
+// login trades a login code for the session cookie, then sends the browser to the page.  If the code has been used
+// or has expired, a new login URL is logged for whoever is at the terminal.
+func (ac *Access) login(req *http.Request) (interface{}, error) {
+	code := req.URL.Query().Get("code")
+	ac.mu.Lock()
+	minted, ok := ac.logins[code]
+	delete(ac.logins, code)
+	session := ac.session
+	ac.mu.Unlock()
+	if !ok || time.Since(minted) > loginTTL {
+		if cfg.addr != nil {
+			// not req.Host, which would let anyone send the next code to a host of their choosing.
+			log.Println("log in at " + serviceURL(cfg.scheme, cfg.addr) + ac.LoginURL())
+		}
+		return tarantula.HttpError{Code: 401, Msg: "that login URL has expired or has already been used; livefire has printed a new one"}, nil
+	}
+	return tarantula.WithCookie{
+		Cookie: &http.Cookie{
+			Name:     authCookie,
+			Value:    session,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   req.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		},
+		Next: tarantula.ForwardToURL{URL: "/"},
+	}, nil
+}
+
+func (ac *Access) allowed(remote string) bool {
+	if len(ac.Allow) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host == "" || host == "@" // unix sockets are local.
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, n := range ac.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripCredentials keeps livefire's own credentials from being forwarded upstream.
+func (ac *Access) stripCredentials(h http.Header) {
+	if ac.Basic != "" {
+		h.Del("Authorization")
+	}
+	if !ac.Token {
+		return
+	}
+	var kept []string
+	for _, line := range h["Cookie"] {
+		for _, part := range strings.Split(line, ";") {
+			if strings.HasPrefix(strings.TrimSpace(part), authCookie+"=") {
+				continue
+			}
+			kept = append(kept, strings.TrimSpace(part))
+		}
+	}
+	h.Del("Cookie")
+	if len(kept) > 0 {
+		h.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+// sameOrigin wraps fn so requests that change something are turned away if a page from another site sent them,
+// since any page can POST to livefire without asking first.  Requests that say nothing about where they came from,
+// like curl's, are let through.
+func sameOrigin(fn tarantula.Func) tarantula.Func {
+	return func(req *http.Request) (interface{}, error) {
+		if req.Method != "GET" && req.Method != "HEAD" && crossOrigin(req) {
+			return nil, tarantula.HttpError{Code: 403, Msg: "cross-origin requests are not allowed"}
+		}
+		return fn(req)
+	}
+}
+
+// crossOrigin reports whether req came from a page on another origin, according to Sec-Fetch-Site or Origin.
+func crossOrigin(req *http.Request) bool {
+	switch req.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return true
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || u.Host != req.Host
+}
+
+// newLogin answers /.livefire/login/new with a fresh login URL, for bringing another device along.
+func newLogin(req *http.Request) (interface{}, error) {
+	if !cfg.Access.Token {
+		return nil, tarantula.HttpError{Code: 404, Msg: "logins are not required"}
+	}
+	return fmt.Sprintf("%v://%v%v", requestScheme(req), req.Host, cfg.Access.LoginURL()), nil
+}
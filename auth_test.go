@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	tarantula "github.com/swdunlop/tarantula-go"
+)
+
+// guardStatus runs a request through ac.guard, returning the status it would get, or 0 if it is let through.
+func guardStatus(t *testing.T, ac *Access, req *http.Request) (int, http.Header) {
+	val, err := ac.guard(req)
+	if val == nil && err == nil {
+		return 0, nil
+	}
+	rw := httptest.NewRecorder()
+	err = tarantula.RespondToHttp(rw, val, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rw.Code, rw.Header()
+}
+
+func TestAccessAllowed(t *testing.T) {
+	var ac Access
+	if !ac.allowed("203.0.113.9:1234") {
+		t.Errorf("everyone is allowed without -allow")
+	}
+	ac.Allow.Set("192.168.1.0/24,2001:db8::1")
+	for _, c := range []struct {
+		remote string
+		ok     bool
+	}{
+		{"127.0.0.1:1234", true},
+		{"[::1]:1234", true},
+		{"192.168.1.20:1234", true},
+		{"192.168.2.20:1234", false},
+		{"[2001:db8::1]:1234", true},
+		{"[2001:db8::2]:1234", false},
+		{"@", true},
+		{"", true},
+		{"example.com:80", false},
+	} {
+		if ac.allowed(c.remote) != c.ok {
+			t.Errorf("%#v: expected allowed to be %v", c.remote, c.ok)
+		}
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.2.20:1234"
+	if code, _ := guardStatus(t, &ac, req); code != 403 {
+		t.Errorf("guard gave %v to a client that is not allowed", code)
+	}
+}
+
+func TestAccessBasic(t *testing.T) {
+	ac := Access{Basic: "user:secret"}
+	req := httptest.NewRequest("GET", "/", nil)
+	code, h := guardStatus(t, &ac, req)
+	if code != 401 || !strings.HasPrefix(h.Get("WWW-Authenticate"), "Basic") {
+		t.Errorf("without credentials, got %v and %#v", code, h)
+	}
+	req.SetBasicAuth("user", "wrong")
+	if code, _ := guardStatus(t, &ac, req); code != 401 {
+		t.Errorf("with the wrong password, got %v", code)
+	}
+	req.SetBasicAuth("user", "secret")
+	if code, _ := guardStatus(t, &ac, req); code != 0 {
+		t.Errorf("with the right password, got %v", code)
+	}
+}
+
+func TestAccessToken(t *testing.T) {
+	ac := Access{Token: true}
+	url := ac.LoginURL()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	if code, _ := guardStatus(t, &ac, req); code != 401 {
+		t.Errorf("without the cookie, got %v", code)
+	}
+	req.AddCookie(&http.Cookie{Name: authCookie, Value: "guess"})
+	if code, _ := guardStatus(t, &ac, req); code != 401 {
+		t.Errorf("with the wrong cookie, got %v", code)
+	}
+
+	code, h := guardStatus(t, &ac, httptest.NewRequest("GET", url, nil))
+	if code/100 != 3 || h.Get("Location") != "/" {
+		t.Fatalf("logging in got %v and %#v", code, h)
+	}
+	cookies := (&http.Response{Header: h}).Cookies()
+	if len(cookies) != 1 || cookies[0].Name != authCookie || !cookies[0].HttpOnly {
+		t.Fatalf("logging in set %#v", cookies)
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	if code, _ := guardStatus(t, &ac, req); code != 0 {
+		t.Errorf("with the session cookie, got %v", code)
+	}
+
+	if code, _ := guardStatus(t, &ac, httptest.NewRequest("GET", url, nil)); code != 401 {
+		t.Errorf("using a login URL twice got %v", code)
+	}
+	if code, _ := guardStatus(t, &ac, httptest.NewRequest("GET", "/.livefire/login?code=", nil)); code != 401 {
+		t.Errorf("logging in without a code got %v", code)
+	}
+}
+
+func TestAccessLoginExpires(t *testing.T) {
+	ac := Access{Token: true}
+	old := ac.LoginURL()
+	fresh := ac.LoginURL()
+	code := old[strings.Index(old, "=")+1:]
+	ac.logins[code] = time.Now().Add(-loginTTL - time.Second)
+	if status, _ := guardStatus(t, &ac, httptest.NewRequest("GET", old, nil)); status != 401 {
+		t.Errorf("an expired login URL got %v", status)
+	}
+	if status, _ := guardStatus(t, &ac, httptest.NewRequest("GET", fresh, nil)); status/100 != 3 {
+		t.Errorf("a fresh login URL got %v", status)
+	}
+
+	// expired codes are forgotten as new ones are minted.
+	for i := 0; i < 10; i++ {
+		ac.LoginURL()
+	}
+	for code := range ac.logins {
+		ac.logins[code] = time.Now().Add(-loginTTL - time.Second)
+	}
+	ac.LoginURL()
+	if len(ac.logins) != 1 {
+		t.Errorf("expected expired codes to be forgotten, but %v remain", len(ac.logins))
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+
+	tarantula "github.com/swdunlop/tarantula-go"
+)
+
+// presentDashboard answers /.livefire/ with a page that follows /.livefire/status and /.livefire/inspect.json.
+func presentDashboard(req *http.Request) (interface{}, error) {
+	if req.URL.Path != "/.livefire/" {
+		return nil, tarantula.HttpError{Code: 404, Msg: "not found"}
+	}
+	return tarantula.WithTemplate{Tmpl: dashboardTmpl, Data: &cfg}, nil
+}
+
+var dashboardTmpl = template.Must(template.New("dashboard").Parse(`<html><head>
+  <title>{{.Title}} - Dashboard</title>
+  <style>
+    body { font-family: sans-serif; margin: 1em; font-size: 14px; }
+    h2 { font-size: 16px; margin: 1.5em 0 0.5em; }
+    table { border-collapse: collapse; width: 100%; font-size: 13px; }
+    td, th { text-align: left; padding: 2px 6px; vertical-align: top; }
+    tr:nth-child(even) { background: #f6f6f6; }
+    .quiet { color: #888; }
+    .err { color: #b00; }
+    .fresh { animation: fresh 2s; }
+    @keyframes fresh { from { background: #ffd; } to { background: transparent; } }
+    #state { margin-left: 1em; }
+  </style>
+</head><body>
+  <div>
+    <button id="reload">Reload all browsers</button>
+    <button id="pause">Pause reloading</button>
+    <span id="state" class="quiet">connecting...</span>
+  </div>
+
+  <h2>Watched files</h2>
+  <table><thead><tr><th>Path</th><th>Last change</th><th>Changes</th></tr></thead><tbody id="watched"></tbody></table>
+
+  <h2>Browsers</h2>
+  <table><thead><tr><th>Client</th><th>Address</th><th>Page</th><th>User agent</th><th>Connected</th><th>Last seen</th><th></th></tr></thead><tbody id="clients"></tbody></table>
+
+  <h2>Recent forwarded requests <a class="quiet" href="/.livefire/inspect">inspect</a></h2>
+  <table><thead><tr><th>#</th><th>Method</th><th>URL</th><th>Status</th><th>Time</th></tr></thead><tbody id="requests"></tbody></table>
+
+  <h2>Forwards</h2>
+  <table><thead><tr><th>Prefix</th><th>URL</th></tr></thead><tbody id="forwards"></tbody></table>
+
+  <h2>Errors</h2>
+  <table><thead><tr><th>Time</th><th>What</th><th>Error</th></tr></thead><tbody id="errors"></tbody></table>
+
+  <script>(function(){
+    "use strict";
+    var paused = false, exchanges = {}, requestLimit = 25;
+    var text = function(s) { return document.createTextNode(s == null ? "" : String(s)); };
+    var el = function(tag, kids) {
+      var e = document.createElement(tag);
+      (kids || []).forEach(function(k) { e.appendChild(typeof k === "object" ? k : text(k)); });
+      return e;
+    };
+    var ago = function(t) {
+      if (!t) return "";
+      var s = Math.round((Date.now() - new Date(t).getTime()) / 1000);
+      if (s < 60) return s + "s ago";
+      if (s < 3600) return Math.round(s / 60) + "m ago";
+      return new Date(t).toLocaleTimeString();
+    };
+    var fill = function(id, rows) {
+      var tbody = document.getElementById(id);
+      tbody.innerHTML = "";
+      if (rows.length === 0) {
+        var td = el("td", ["none"]);
+        td.className = "quiet";
+        td.colSpan = tbody.parentNode.querySelectorAll("th").length;
+        tbody.appendChild(el("tr", [td]));
+      }
+      rows.forEach(function(r) { tbody.appendChild(r); });
+    };
+    var post = function(url) {
+      var xhr = new XMLHttpRequest();
+      xhr.open("POST", url, true);
+      xhr.send();
+    };
+    document.getElementById("reload").onclick = function() { post("/.livefire/status/reload"); };
+    document.getElementById("pause").onclick = function() {
+      post("/.livefire/status/watch?paused=" + (paused ? "0" : "1"));
+    };
+
+    var status = null;
+    var render = function() {
+      if (!status) return;
+      paused = status.paused;
+      document.getElementById("pause").textContent = paused ? "Resume reloading" : "Pause reloading";
+      document.getElementById("state").textContent = status.browsers + " browser(s) waiting" + (paused ? ", reloading paused" : "");
+      fill("watched", status.watched.map(function(w) {
+        var tr = el("tr", [w.path + (w.mode ? " (" + w.mode + ")" : ""), ago(w.changed), w.history.slice().reverse().map(ago).join(", ")]);
+        if (w.changed && Date.now() - new Date(w.changed).getTime() < 2000) tr.className = "fresh";
+        return tr;
+      }));
+      fill("clients", status.clients.map(function(c) {
+        var btn = el("button", ["Reload"]);
+        btn.onclick = function() { post("/.livefire/status/reload?client=" + encodeURIComponent(c.id)); };
+        var tr = el("tr", [c.id, c.addr, c.page, c.userAgent, ago(c.connected), c.waiting ? "waiting" : ago(c.lastSeen), btn]);
+        if (!c.waiting) tr.className = "quiet";
+        return tr;
+      }));
+      fill("forwards", status.forwards.map(function(f) {
+        return el("tr", [f.prefix + (f.strip ? " (stripped)" : ""), f.url]);
+      }));
+      fill("errors", status.errors.slice().reverse().map(function(e) {
+        var tr = el("tr", [new Date(e.time).toLocaleTimeString(), e.what, e.error]);
+        tr.className = "err";
+        return tr;
+      }));
+    };
+    var renderRequests = function() {
+      var ids = Object.keys(exchanges).map(Number).sort(function(a, b) { return b - a; });
+      ids.slice(requestLimit).forEach(function(id) { delete exchanges[id]; });
+      fill("requests", ids.slice(0, requestLimit).map(function(id) {
+        var ex = exchanges[id];
+        var tr = el("tr", [ex.id, ex.method, ex.url, ex.error ? "error" : (ex.status || "..."), ex.done ? Math.round(ex.elapsedMs) + " ms" : "..."]);
+        if (ex.error || ex.status >= 500) tr.className = "err";
+        return tr;
+      }));
+    };
+
+    // Both polls follow the same pattern: ask for anything newer than what we have, and back off on errors.
+    var follow = function(url, seq, fn) {
+      var xhr = new XMLHttpRequest();
+      xhr.open("GET", url + "?since=" + seq, true);
+      xhr.onreadystatechange = function() {
+        if (xhr.readyState < 4) return;
+        if (xhr.status !== 200) {
+          document.getElementById("state").textContent = "disconnected";
+          window.setTimeout(function() { follow(url, seq, fn); }, 2000);
+          return;
+        }
+        var rsp = JSON.parse(xhr.responseText);
+        fn(rsp);
+        follow(url, rsp.seq, fn);
+      };
+      xhr.send();
+    };
+    follow("/.livefire/status", -1, function(rsp) { status = rsp; render(); });
+    follow("/.livefire/inspect.json", 0, function(rsp) {
+      rsp.exchanges.forEach(function(ex) { exchanges[ex.id] = ex; });
+      renderRequests();
+    });
+    window.setInterval(render, 5000); // keep the "ago"s honest.
+  })();</script>
+</body></html>`))
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tarantula "github.com/swdunlop/tarantula-go"
+)
+
+// Fault describes trouble to inflict on responses for paths under Prefix.
+type Fault struct {
+	Prefix  string  `json:"prefix"`
+	Latency string  `json:"latency,omitempty"` // added before responding, like "250ms"
+	Jitter  string  `json:"jitter,omitempty"`  // up to this much more latency, chosen at random
+	Rate    int     `json:"rate,omitempty"`    // bytes per second for response bodies
+	Error   float64 `json:"error,omitempty"`   // chance of answering with Status instead
+	Status  int     `json:"status,omitempty"`  // defaults to 503
+	Drop    float64 `json:"drop,omitempty"`    // chance of closing the connection without a response
+	latency time.Duration
+	jitter  time.Duration
+}
+
+// Faults holds the fault rules from the command line, and any replacements sent to /.livefire/faults; it
+// implements flag.Value.
+type Faults struct {
+	mu       sync.Mutex
+	Disabled bool
+	Rules    []*Fault
+}
+
+func (fs *Faults) String() string {
+	if fs == nil {
+		return ""
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	ss := make([]string, len(fs.Rules))
+	for i, f := range fs.Rules {
+		ss[i] = f.String()
+	}
+	return strings.Join(ss, " ")
+}
+
+// Set parses PREFIX=RULE,RULE... where each rule is latency=DURATION, jitter=DURATION, rate=BYTES,
+// error=CHANCE, status=CODE or drop=CHANCE.  Rates may end in k or m, for kilobytes and megabytes.
+func (fs *Faults) Set(arg string) error {
+	i := strings.Index(arg, "=")
+	if i < 0 || !strings.HasPrefix(arg, "/") {
+		return fmt.Errorf(`expected PREFIX=RULE,..., got %#v`, arg)
+	}
+	f := &Fault{Prefix: arg[:i]}
+	for _, rule := range strings.Split(arg[i+1:], ",") {
+		j := strings.Index(rule, "=")
+		if j < 0 {
+			return fmt.Errorf(`expected NAME=VALUE, got %#v`, rule)
+		}
+		var err error
+		key, val := strings.TrimSpace(rule[:j]), strings.TrimSpace(rule[j+1:])
+		switch key {
+		case "latency":
+			f.Latency = val
+		case "jitter":
+			f.Jitter = val
+		case "rate":
+			f.Rate, err = parseRate(val)
+		case "error":
+			f.Error, err = strconv.ParseFloat(val, 64)
+		case "status":
+			f.Status, err = strconv.Atoi(val)
+		case "drop":
+			f.Drop, err = strconv.ParseFloat(val, 64)
+		default:
+			err = fmt.Errorf(`unknown fault %#v`, key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err := f.prepare()
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	fs.Rules = append(fs.Rules, f)
+	fs.mu.Unlock()
+	return nil
+}
+
+func (f *Fault) String() string {
+	var rules []string
+	if f.Latency != "" {
+		rules = append(rules, "latency="+f.Latency)
+	}
+	if f.Jitter != "" {
+		rules = append(rules, "jitter="+f.Jitter)
+	}
+	if f.Rate != 0 {
+		rules = append(rules, fmt.Sprint("rate=", f.Rate))
+	}
+	if f.Error != 0 {
+		rules = append(rules, fmt.Sprint("error=", f.Error))
+	}
+	if f.Status != 0 {
+		rules = append(rules, fmt.Sprint("status=", f.Status))
+	}
+	if f.Drop != 0 {
+		rules = append(rules, fmt.Sprint("drop=", f.Drop))
+	}
+	return f.Prefix + "=" + strings.Join(rules, ",")
+}
+
+func parseRate(s string) (int, error) {
+	mul := 1
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mul, s = 1<<10, strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "m"):
+		mul, s = 1<<20, strings.TrimSuffix(s, "m")
+	}
+	n, err := strconv.Atoi(s)
+	return n * mul, err
+}
+
+// prepare validates f and parses its durations.
+func (f *Fault) prepare() error {
+	var err error
+	if !strings.HasPrefix(f.Prefix, "/") {
+		return fmt.Errorf(`fault prefix %#v must start with /`, f.Prefix)
+	}
+	if f.Latency != "" {
+		f.latency, err = time.ParseDuration(f.Latency)
+		if err != nil {
+			return err
+		}
+	}
+	if f.Jitter != "" {
+		f.jitter, err = time.ParseDuration(f.Jitter)
+		if err != nil {
+			return err
+		}
+	}
+	if f.Status == 0 {
+		f.Status = 503
+	}
+	return nil
+}
+
+// Match finds the fault with the longest prefix covering p, or nil if faults are disabled or none apply.
+func (fs *Faults) Match(p string) *Fault {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.Disabled {
+		return nil
+	}
+	var best *Fault
+	for _, f := range fs.Rules {
+		prefix := strings.TrimSuffix(f.Prefix, "/")
+		if p != prefix && !strings.HasPrefix(p, prefix+"/") {
+			continue
+		}
+		if best == nil || len(f.Prefix) > len(best.Prefix) {
+			best = f
+		}
+	}
+	return best
+}
+
+// withFaults wraps fn so responses suffer any matching fault.
+func withFaults(fn tarantula.Func) tarantula.Func {
+	return func(req *http.Request) (interface{}, error) {
+		f := cfg.Faults.Match(req.URL.Path)
+		if f == nil {
+			return fn(req)
+		}
+
+		delay := f.latency
+		if f.jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(f.jitter)))
+		}
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		}
+		switch {
+		case f.Drop > 0 && rand.Float64() < f.Drop:
+			log.Printf("dropping %v %v", req.Method, req.URL.Path)
+			return droppedConnection{}, nil
+		case f.Error > 0 && rand.Float64() < f.Error:
+			log.Printf("failing %v %v with %v", req.Method, req.URL.Path, f.Status)
+			return tarantula.HttpError{Code: f.Status, Msg: "injected fault"}, nil
+		}
+
+		v, err := fn(req)
+		if err != nil || f.Rate <= 0 {
+			return v, err
+		}
+		return throttled{v, f.Rate}, nil
+	}
+}
+
+// droppedConnection closes the browser's connection without a word.
+type droppedConnection struct{}
+
+func (droppedConnection) RespondToHttp(w http.ResponseWriter) error {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler) // HTTP/2 can't be hijacked, but this still resets the stream.
+	}
+	return conn.Close()
+}
+
+// throttled relays Next to the browser no faster than Rate bytes per second.
+type throttled struct {
+	Next interface{}
+	Rate int
+}
+
+func (t throttled) RespondToHttp(w http.ResponseWriter) error {
+	return tarantula.RespondToHttp(&throttledWriter{ResponseWriter: w, rate: t.Rate}, t.Next, nil)
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	rate int
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := tw.rate / 10
+		if chunk < 1 {
+			chunk = 1
+		}
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		n, err := tw.ResponseWriter.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		http.NewResponseController(tw.ResponseWriter).Flush()
+		time.Sleep(time.Duration(chunk) * time.Second / time.Duration(tw.rate))
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+func (tw *throttledWriter) Flush() {
+	http.NewResponseController(tw.ResponseWriter).Flush()
+}
+
+func (tw *throttledWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(tw.ResponseWriter).Hijack()
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// controlFaults answers /.livefire/faults.  GET lists the rules, POST with ?enabled=0 or 1 switches them off or
+// on, and POST with a JSON list of rules replaces them.
+func controlFaults(req *http.Request) (interface{}, error) {
+	fs := &cfg.Faults
+	if req.Method == "POST" {
+		if s := req.URL.Query().Get("enabled"); s != "" {
+			on, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, tarantula.HttpError{Code: 400, Msg: err.Error()}
+			}
+			fs.mu.Lock()
+			fs.Disabled = !on
+			fs.mu.Unlock()
+		} else {
+			var rules []*Fault
+			err := json.NewDecoder(req.Body).Decode(&rules)
+			if err != nil {
+				return nil, tarantula.HttpError{Code: 400, Msg: err.Error()}
+			}
+			for _, f := range rules {
+				err = f.prepare()
+				if err != nil {
+					return nil, tarantula.HttpError{Code: 400, Msg: err.Error()}
+				}
+			}
+			fs.mu.Lock()
+			fs.Rules = rules
+			fs.mu.Unlock()
+		}
+		log.Printf("faults are now %v", fs.String())
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var rsp struct {
+		Enabled bool     `json:"enabled"`
+		Rules   []*Fault `json:"rules"`
+	}
+	rsp.Enabled = !fs.Disabled
+	rsp.Rules = append([]*Fault{}, fs.Rules...)
+	return rsp, nil
+}
@@ -8,11 +8,12 @@ package main
 import (
 	"github.com/howeyc/fsnotify"
 	"path/filepath"
+	"sync"
 )
 
-func Stalk(paths ...string) (chan string, error) {
+func Stalk(paths ...string) (*Stalker, error) {
 	var err error
-	sr := new(stalker)
+	sr := new(Stalker)
 	sr.req = make(map[string]bool)
 	sr.fs, err = fsnotify.NewWatcher()
 	for _, path := range paths {
@@ -24,18 +25,47 @@ func Stalk(paths ...string) (chan string, error) {
 		sr.watch(path)
 		sr.req[path] = true
 	}
-	sr.ch = make(chan string, 32)
+	sr.C = make(chan string, 32)
 	go sr.process()
-	return sr.ch, err
+	return sr, err
 }
 
-type stalker struct {
-	ch  chan string
+// Stalker reports the absolute path of files that change on C.
+type Stalker struct {
+	C   chan string
 	fs  *fsnotify.Watcher
+	mu  sync.Mutex
 	req map[string]bool
 }
 
-func (sr *stalker) watch(path string) {
+// Follow starts reporting changes to path, as though it had been given to Stalk.
+func (sr *Stalker) Follow(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.watch(path)
+	sr.req[path] = true
+	return nil
+}
+
+// Unfollow stops reporting changes to path; it is still watched, since it may be the parent of another path.
+func (sr *Stalker) Unfollow(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if _, ok := sr.req[path]; ok {
+		sr.req[path] = false
+	}
+	return nil
+}
+
+func (sr *Stalker) watch(path string) {
 	_, ok := sr.req[path]
 	if ok {
 		return // already watching
@@ -49,8 +79,8 @@ func (sr *stalker) watch(path string) {
 	sr.watch(dir)
 }
 
-func (sr *stalker) process() {
-	defer close(sr.ch)
+func (sr *Stalker) process() {
+	defer close(sr.C)
 	defer sr.fs.Close()
 	for {
 		select {
@@ -62,21 +92,22 @@ func (sr *stalker) process() {
 	}
 }
 
-func (sr *stalker) processEvent(event *fsnotify.FileEvent) {
+func (sr *Stalker) processEvent(event *fsnotify.FileEvent) {
+	sr.mu.Lock()
 	em, ok := sr.req[event.Name]
+	if ok && event.IsCreate() {
+		sr.fs.Watch(event.Name)
+	}
+	sr.mu.Unlock()
 	if !ok {
 		return //yawn
 	}
-	switch {
-	case event.IsCreate():
-		sr.fs.Watch(event.Name)
-	}
 	if em {
-		sr.ch <- event.Name
+		sr.C <- event.Name
 	}
 }
 
-func (sr *stalker) processError(err error) {
-	println("!! fs monitor", err.Error())
+func (sr *Stalker) processError(err error) {
+	reportError("fs monitor", err)
 }
 
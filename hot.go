@@ -0,0 +1,18 @@
+package main
+
+import "path/filepath"
+
+// isModule reports whether file is an ES module, which livefire serves with import.meta.hot for hot module
+// replacement.
+func isModule(file string) bool {
+	return filepath.Ext(file) == ".mjs"
+}
+
+// hotPrelude gives a module its import.meta.hot from the shim; it is put on the module's first line, so line numbers
+// in the browser's console still match the file.  Import declarations are hoisted, so it's fine in front of them.
+const hotPrelude = `if (typeof livefire !== "undefined") import.meta.hot = livefire.hot(import.meta.url); `
+
+// withHot adds hotPrelude to the source of a module.
+func withHot(src []byte) []byte {
+	return append([]byte(hotPrelude), src...)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// serverTLS produces the TLS configuration for serving HTTPS, either from -tls-cert and -tls-key, or from a local
+// CA that livefire creates and keeps in the user's config directory.
+func serverTLS() (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if cfg.TLSCert != "" {
+		key := cfg.TLSKey
+		if key == "" {
+			key = cfg.TLSCert
+		}
+		cert, err = tls.LoadX509KeyPair(cfg.TLSCert, key)
+	} else {
+		cert, err = localCertificate(cfg.Bind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// tlsListen wraps net.Listen so the service speaks HTTPS, and HTTP/2 where browsers ask for it.
+func tlsListen(tc *tls.Config, listen func(string) (net.Listener, error)) func(string) (net.Listener, error) {
+	return func(addr string) (net.Listener, error) {
+		l, err := listen(addr)
+		if err != nil {
+			return nil, err
+		}
+		return tls.NewListener(l, tc), nil
+	}
+}
+
+// certDir is where the local CA and the certificates it issues are kept.
+func certDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "livefire")
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// localCertificate loads or issues a certificate for the host in bind, signed by the local CA.
+func localCertificate(bind string) (tls.Certificate, error) {
+	dir, err := certDir()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	ca, caKey, err := localCA(dir)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	names := certNames(bind)
+	sum := sha256.Sum256([]byte(strings.Join(names, ",")))
+	base := filepath.Join(dir, "leaf-"+hex.EncodeToString(sum[:6]))
+	cert, err := tls.LoadX509KeyPair(base+".pem", base+"-key.pem")
+	if err == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err == nil && time.Now().Add(24*time.Hour).Before(leaf.NotAfter) && leaf.CheckSignatureFrom(ca) == nil {
+			return cert, nil
+		}
+	}
+
+	log.Printf("issuing a certificate for %v", strings.Join(names, ", "))
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"livefire"}, CommonName: names[0]},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(397 * 24 * time.Hour), // the most browsers will accept.
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+	}
+	err = issueCertificate(base, tmpl, ca, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.LoadX509KeyPair(base+".pem", base+"-key.pem")
+}
+
+// localCA loads the local CA, creating it if necessary.
+func localCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	base := filepath.Join(dir, "ca")
+	_, err := os.Stat(base + ".pem")
+	if os.IsNotExist(err) {
+		tmpl := &x509.Certificate{
+			Subject:               pkix.Name{Organization: []string{"livefire"}, CommonName: "livefire local CA"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			MaxPathLenZero:        true,
+		}
+		err = issueCertificate(base, tmpl, nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("created a local CA; trust %v in your browser to avoid certificate warnings", base+".pem")
+	}
+
+	pair, err := tls.LoadX509KeyPair(base+".pem", base+"-key.pem")
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf(`%v-key.pem is not an ECDSA key`, base)
+	}
+	return ca, key, nil
+}
+
+// issueCertificate writes a new key to base-key.pem and a certificate for it to base.pem, signed by parent, or
+// self-signed if parent is nil.
+func issueCertificate(base string, tmpl, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(base+"-key.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(base+".pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// certNames lists the names a certificate for bind should cover; wildcard binds cover every local address.
+func certNames(bind string) []string {
+	host, _, err := net.SplitHostPort(bind)
+	switch {
+	case strings.HasPrefix(bind, "unix:"):
+		host = "localhost"
+	case strings.HasPrefix(bind, "systemd"):
+		host = "" // no telling what systemd is listening on.
+	case err != nil:
+		host = bind
+	}
+	seen := map[string]bool{"localhost": true, "127.0.0.1": true, "::1": true}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		addrs, _ := net.InterfaceAddrs()
+		for _, addr := range addrs {
+			if ipn, ok := addr.(*net.IPNet); ok {
+				seen[ipn.IP.String()] = true
+			}
+		}
+		if name, err := os.Hostname(); err == nil {
+			seen[name] = true
+		}
+	} else {
+		seen[host] = true
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		if name != host {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if seen[host] {
+		names = append([]string{host}, names...)
+	}
+	return names
+}
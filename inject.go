@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isHTML reports whether a Content-Type header describes an HTML document.
+func isHTML(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mt == "text/html"
+}
+
+// injectShim inserts the refresh shim before the last </body> in doc; documents without one get it appended.
+func injectShim(doc []byte) []byte {
+	var shim bytes.Buffer
+	err := tmpl.ExecuteTemplate(&shim, "shim", &Content{Time: time.Now().Unix(), Client: newClientID(), Cfg: &cfg})
+	if err != nil {
+		reportError("shim", err)
+		return doc
+	}
+
+	i := bytes.LastIndex(asciiLower(doc), []byte("</body>"))
+	if i < 0 {
+		return append(doc, shim.Bytes()...)
+	}
+	out := make([]byte, 0, len(doc)+shim.Len())
+	out = append(out, doc[:i]...)
+	out = append(out, shim.Bytes()...)
+	return append(out, doc[i:]...)
+}
+
+// asciiLower lowercases only ASCII letters in doc, so indexes into it are still good for doc; bytes.ToLower can
+// change the length of other characters, like İ.
+func asciiLower(doc []byte) []byte {
+	lower := make([]byte, len(doc))
+	for i, c := range doc {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
+	}
+	return lower
+}
+
+// injectProxyResponse replaces the body of rsp with a decompressed copy that includes the refresh shim.  Encodings
+// we don't understand, and responses that have no body, are left alone.
+func injectProxyResponse(rsp *http.Response) error {
+	if rsp.Body == nil || rsp.ContentLength == 0 {
+		return nil
+	}
+	if rsp.Request != nil && rsp.Request.Method == "HEAD" {
+		return nil
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode == 204 || rsp.StatusCode == 304 {
+		return nil
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(rsp.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity", "gzip", "x-gzip", "deflate":
+	default:
+		return nil // brotli and friends pass through untouched.
+	}
+
+	data, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		rsp.Body = ioutil.NopCloser(bytes.NewReader(data))
+		return nil // the upstream didn't say how long it was, but it was empty.
+	}
+	data, err = decodeBody(encoding, data)
+	if err != nil {
+		return err
+	}
+	data = injectShim(data)
+
+	rsp.Header.Del("Content-Encoding")
+	rsp.Header.Del("ETag") // it describes the upstream's body, not ours.
+	rsp.Header.Del("Last-Modified")
+	rsp.Header.Set("Content-Length", fmt.Sprint(len(data)))
+	rsp.ContentLength = int64(len(data))
+	rsp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return nil
+}
+
+// decodeBody undoes a gzip or deflate Content-Encoding.  Deflate is supposed to be zlib wrapped, but some servers
+// send raw deflate streams, so we try both.
+func decodeBody(encoding string, data []byte) ([]byte, error) {
+	var rd io.ReadCloser
+	var err error
+	switch encoding {
+	case "gzip", "x-gzip":
+		rd, err = gzip.NewReader(bytes.NewReader(data))
+	case "deflate":
+		rd, err = zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			rd, err = flate.NewReader(bytes.NewReader(data)), nil
+		}
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return ioutil.ReadAll(rd)
+}
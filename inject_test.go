@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestInjectShimKeepsCharacters(t *testing.T) {
+	doc := injectShim([]byte("<html><body>İİİ</BODY></html>"))
+	if !utf8.Valid(doc) {
+		t.Fatalf("shim split a character: %q", doc)
+	}
+	if !bytes.HasPrefix(doc, []byte("<html><body>İİİ<script>")) {
+		t.Fatalf("shim is not before </BODY>: %q", doc)
+	}
+	if !bytes.HasSuffix(doc, []byte("</script></BODY></html>")) {
+		t.Fatalf("shim is not before </BODY>: %q", doc)
+	}
+}
+
+func TestInjectProxyResponseSkipsBodiless(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("<html><body>hi</body></html>"))
+	zw.Close()
+
+	for _, c := range []struct {
+		name     string
+		method   string
+		status   int
+		encoding string
+		body     []byte
+		length   int64
+		inject   bool
+	}{
+		{"get", "GET", 200, "", []byte("<html><body>hi</body></html>"), -1, true},
+		{"gzip", "GET", 200, "gzip", gz.Bytes(), int64(gz.Len()), true},
+		{"head", "HEAD", 200, "gzip", nil, 0, false},
+		{"not modified", "GET", 304, "", nil, -1, false},
+		{"no content", "GET", 204, "gzip", nil, -1, false},
+		{"empty gzip", "GET", 200, "gzip", nil, -1, false},
+	} {
+		req, _ := http.NewRequest(c.method, "http://upstream/", nil)
+		rsp := &http.Response{
+			StatusCode:    c.status,
+			Header:        http.Header{"Etag": {`"x"`}, "Last-Modified": {"yesterday"}},
+			Body:          ioutil.NopCloser(bytes.NewReader(c.body)),
+			ContentLength: c.length,
+			Request:       req,
+		}
+		if c.encoding != "" {
+			rsp.Header.Set("Content-Encoding", c.encoding)
+		}
+		err := injectProxyResponse(rsp)
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(rsp.Body)
+		injected := strings.Contains(string(body), "<script>")
+		if injected != c.inject {
+			t.Errorf("%v: injected is %v, expected %v", c.name, injected, c.inject)
+		}
+		if injected && (rsp.Header.Get("ETag") != "" || rsp.Header.Get("Last-Modified") != "") {
+			t.Errorf("%v: kept the upstream's validators", c.name)
+		}
+		if injected && rsp.ContentLength != int64(len(body)) {
+			t.Errorf("%v: Content-Length is %v for %v bytes", c.name, rsp.ContentLength, len(body))
+		}
+	}
+}
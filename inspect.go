@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	tarantula "github.com/swdunlop/tarantula-go"
+)
+
+// inspectBodyLimit caps how much of each request and response body the inspector keeps.
+const inspectBodyLimit = 16 << 10
+
+// Exchange records a single forwarded request and what came back from the upstream.
+type Exchange struct {
+	ID        int64       `json:"id"`
+	Seq       int64       `json:"seq"`
+	Time      time.Time   `json:"time"`
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Upstream  string      `json:"upstream"`
+	ReqHeader http.Header `json:"reqHeader"`
+	ReqBody   string      `json:"reqBody,omitempty"`
+	Status    int         `json:"status,omitempty"`
+	RspHeader http.Header `json:"rspHeader,omitempty"`
+	RspBody   string      `json:"rspBody,omitempty"`
+	Headers   float64     `json:"headersMs,omitempty"` // until the upstream's response headers arrived
+	Elapsed   float64     `json:"elapsedMs,omitempty"` // until the response body was finished
+	Done      bool        `json:"done"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// Inspector keeps the most recent exchanges in a ring, and wakes up anyone waiting for news.
+type Inspector struct {
+	mu      sync.Mutex
+	ring    []Exchange
+	next    int64 // next exchange ID
+	seq     int64 // bumped whenever an exchange changes
+	changed chan struct{}
+}
+
+// NewInspector creates an Inspector that remembers up to size exchanges; a size of zero or less disables it.
+func NewInspector(size int) *Inspector {
+	size = max(size, 0)
+	return &Inspector{ring: make([]Exchange, size), changed: make(chan struct{})}
+}
+
+// update applies fn to exchange id, if it is still in the ring, and wakes any waiters.
+func (in *Inspector) update(id int64, fn func(ex *Exchange)) {
+	if len(in.ring) == 0 || id < 0 {
+		return
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	ex := &in.ring[id%int64(len(in.ring))]
+	if ex.ID != id {
+		return // lapped.
+	}
+	fn(ex)
+	in.touch(ex)
+}
+
+// touch marks ex as changed and wakes any waiters; in.mu must be held.
+func (in *Inspector) touch(ex *Exchange) {
+	in.seq++
+	ex.Seq = in.seq
+	close(in.changed)
+	in.changed = make(chan struct{})
+}
+
+// Begin records an outbound request, returning the ID used to report its outcome, or -1 when inspection is off.
+func (in *Inspector) Begin(inbound, out *http.Request) int64 {
+	if len(in.ring) == 0 {
+		return -1
+	}
+	in.mu.Lock()
+	id := in.next
+	in.next++
+	ex := &in.ring[id%int64(len(in.ring))]
+	*ex = Exchange{
+		ID:        id,
+		Time:      time.Now(),
+		Method:    inbound.Method,
+		URL:       inbound.URL.String(),
+		Upstream:  out.URL.String(),
+		ReqHeader: out.Header.Clone(),
+	}
+	in.touch(ex)
+	in.mu.Unlock()
+
+	if out.Body != nil && out.Body != http.NoBody {
+		out.Body = in.capture(out.Body, out.Header.Get("Content-Encoding"), func(body string) {
+			in.update(id, func(ex *Exchange) { ex.ReqBody = body })
+		})
+	}
+	return id
+}
+
+// Respond records the upstream's response headers, and arranges to capture the body as it is relayed.
+func (in *Inspector) Respond(id int64, rsp *http.Response) {
+	if id < 0 {
+		return
+	}
+	in.update(id, func(ex *Exchange) {
+		ex.Status = rsp.StatusCode
+		ex.RspHeader = rsp.Header.Clone()
+		ex.Headers = sinceMs(ex.Time)
+	})
+	if rsp.StatusCode == http.StatusSwitchingProtocols || rsp.Body == nil {
+		in.update(id, func(ex *Exchange) { ex.Done = true; ex.Elapsed = ex.Headers })
+		return // the body is a connection; leave it be.
+	}
+	rsp.Body = in.capture(rsp.Body, rsp.Header.Get("Content-Encoding"), func(body string) {
+		in.update(id, func(ex *Exchange) {
+			ex.RspBody = body
+			ex.Elapsed = sinceMs(ex.Time)
+			ex.Done = true
+		})
+	})
+}
+
+// Fail records an exchange that never got a response.
+func (in *Inspector) Fail(id int64, err error) {
+	in.update(id, func(ex *Exchange) {
+		ex.Error = err.Error()
+		ex.Elapsed = sinceMs(ex.Time)
+		ex.Done = true
+	})
+}
+
+// Since returns exchanges that changed after seq, waiting up to timeout for one to come along.
+func (in *Inspector) Since(req *http.Request, seq int64, timeout time.Duration) (int64, []Exchange) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		in.mu.Lock()
+		cur, changed := in.seq, in.changed
+		var exs []Exchange
+		if cur > seq {
+			for _, ex := range in.ring {
+				if ex.Seq > seq {
+					exs = append(exs, ex)
+				}
+			}
+		}
+		in.mu.Unlock()
+		if len(exs) > 0 {
+			return cur, exs
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return cur, nil
+		case <-req.Context().Done():
+			return cur, nil
+		}
+	}
+}
+
+func (in *Inspector) capture(rc io.ReadCloser, encoding string, done func(body string)) io.ReadCloser {
+	return &captureBody{ReadCloser: rc, encoding: encoding, done: done}
+}
+
+// captureBody keeps the first inspectBodyLimit bytes read through it, and reports them once it is closed, decoded
+// if they have a Content-Encoding we understand.
+type captureBody struct {
+	io.ReadCloser
+	buf       bytes.Buffer
+	total     int64
+	encoding  string
+	done      func(body string)
+	reporting sync.Once
+}
+
+func (cb *captureBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+	cb.total += int64(n)
+	if room := inspectBodyLimit - cb.buf.Len(); room > 0 {
+		if room > n {
+			room = n
+		}
+		cb.buf.Write(p[:room])
+	}
+	if err == io.EOF {
+		cb.report()
+	}
+	return n, err
+}
+
+func (cb *captureBody) Close() error {
+	err := cb.ReadCloser.Close()
+	cb.report()
+	return err
+}
+
+func (cb *captureBody) report() {
+	cb.reporting.Do(func() {
+		data := cb.buf.Bytes()
+		truncated := cb.total > int64(len(data))
+		size := strconv.FormatInt(cb.total, 10) + " bytes"
+		if cb.encoding != "" && len(data) > 0 {
+			plain, err := decodeBody(cb.encoding, data)
+			// a truncated stream fails to decode at the end, but what came before that is still good.
+			if err == nil || (truncated && len(plain) > 0) {
+				data = plain
+				size += " " + cb.encoding
+			}
+		}
+		if len(data) > inspectBodyLimit {
+			data, truncated = data[:inspectBodyLimit], true
+		}
+		if truncated {
+			data = trimRune(data)
+		}
+		var body string
+		switch {
+		case !utf8.Valid(data):
+			body = "(" + size + " of binary data)"
+		case truncated:
+			body = string(data) + "\n(truncated, " + size + " total)"
+		default:
+			body = string(data)
+		}
+		cb.done(body)
+	})
+}
+
+// trimRune drops a character that was cut off at the end of data.
+func trimRune(data []byte) []byte {
+	for i := 1; i <= utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				return data[:len(data)-i]
+			}
+			break
+		}
+	}
+	return data
+}
+
+func sinceMs(t time.Time) float64 {
+	return float64(time.Since(t)) / float64(time.Millisecond)
+}
+
+func presentInspector(req *http.Request) (interface{}, error) {
+	return tarantula.WithTemplate{Tmpl: inspectTmpl, Data: &cfg}, nil
+}
+
+// listExchanges answers /.livefire/inspect.json?since=SEQ, blocking until there is something newer than SEQ.
+func listExchanges(req *http.Request) (interface{}, error) {
+	var since int64
+	if s := req.URL.Query().Get("since"); s != "" {
+		var err error
+		since, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, tarantula.HttpError{Code: 400, Msg: err.Error()}
+		}
+	}
+	if since < 0 {
+		since = 0 // unused slots in the ring have a seq of zero.
+	}
+	var rsp struct {
+		Seq       int64      `json:"seq"`
+		Exchanges []Exchange `json:"exchanges"`
+	}
+	rsp.Seq, rsp.Exchanges = inspector.Since(req, since, 25*time.Second)
+	if rsp.Exchanges == nil {
+		rsp.Exchanges = []Exchange{}
+	}
+	return rsp, nil
+}
+
+var inspector = NewInspector(0)
+
+var inspectTmpl = template.Must(template.New("inspect").Parse(`<html><head>
+  <title>{{.Title}} - Inspector</title>
+  <style>
+    body { font-family: sans-serif; margin: 0; display: flex; height: 100vh; }
+    #list { flex: 1; overflow: auto; border-right: 1px solid #ccc; }
+    #detail { flex: 1; overflow: auto; padding: 0 1em; }
+    table { border-collapse: collapse; width: 100%; font-size: 13px; }
+    td, th { text-align: left; padding: 2px 6px; white-space: nowrap; }
+    tr.row { cursor: pointer; }
+    tr.row:hover, tr.selected { background: #eef; }
+    .err { color: #b00; }
+    pre { background: #f6f6f6; padding: 6px; white-space: pre-wrap; word-break: break-all; }
+  </style>
+</head><body>
+  <div id="list"><table>
+    <thead><tr><th>#</th><th>Method</th><th>URL</th><th>Status</th><th>Time</th></tr></thead>
+    <tbody id="rows"></tbody>
+  </table></div>
+  <div id="detail"><p>Select a request to see what was sent and received.</p></div>
+  <script>(function(){
+    "use strict";
+    var exchanges = {}, rows = {}, selected = null, seq = 0;
+    var text = function(s) { return document.createTextNode(s == null ? "" : String(s)); };
+    var el = function(tag, kids) {
+      var e = document.createElement(tag);
+      (kids || []).forEach(function(k) { e.appendChild(typeof k === "object" ? k : text(k)); });
+      return e;
+    };
+    var headers = function(h) {
+      var lines = [];
+      Object.keys(h || {}).sort().forEach(function(k) {
+        h[k].forEach(function(v) { lines.push(k + ": " + v); });
+      });
+      return lines.join("\n");
+    };
+    var status = function(ex) {
+      if (ex.error) return "error";
+      return ex.status || "...";
+    };
+    var elapsed = function(ex) {
+      return ex.done ? Math.round(ex.elapsedMs) + " ms" : "...";
+    };
+    var show = function(id) {
+      var ex = exchanges[id], d = document.getElementById("detail");
+      if (selected !== null && rows[selected]) rows[selected].className = "row";
+      selected = id;
+      rows[id].className = "row selected";
+      d.innerHTML = "";
+      d.appendChild(el("h3", [ex.method + " " + ex.url]));
+      d.appendChild(el("p", ["forwarded to " + ex.upstream + " at " + ex.time]));
+      if (ex.error) d.appendChild(el("p", [el("b", ["Error: "]), ex.error]));
+      d.appendChild(el("h4", ["Request"]));
+      d.appendChild(el("pre", [headers(ex.reqHeader)]));
+      if (ex.reqBody) d.appendChild(el("pre", [ex.reqBody]));
+      d.appendChild(el("h4", ["Response " + status(ex) + ", headers in " + Math.round(ex.headersMs || 0) + " ms, done in " + elapsed(ex)]));
+      d.appendChild(el("pre", [headers(ex.rspHeader)]));
+      if (ex.rspBody) d.appendChild(el("pre", [ex.rspBody]));
+    };
+    var render = function(ex) {
+      var tr = el("tr", [ex.id, ex.method, ex.url, status(ex), elapsed(ex)]);
+      tr.className = ex.id === selected ? "row selected" : "row";
+      if (ex.error || ex.status >= 500) tr.className += " err";
+      tr.onclick = function() { show(ex.id); };
+      var tbody = document.getElementById("rows");
+      if (rows[ex.id]) {
+        tbody.replaceChild(tr, rows[ex.id]);
+      } else {
+        tbody.insertBefore(tr, tbody.firstChild);
+      }
+      rows[ex.id] = tr;
+    };
+    var poll = function() {
+      var xhr = new XMLHttpRequest();
+      xhr.open("GET", "/.livefire/inspect.json?since=" + seq, true);
+      xhr.onreadystatechange = function() {
+        if (xhr.readyState < 4) return;
+        if (xhr.status !== 200) {
+          window.setTimeout(poll, 2000);
+          return;
+        }
+        var rsp = JSON.parse(xhr.responseText);
+        seq = rsp.seq;
+        rsp.exchanges.sort(function(a, b) { return a.id - b.id; }).forEach(function(ex) {
+          exchanges[ex.id] = ex;
+          render(ex);
+          if (ex.id === selected) show(ex.id);
+        });
+        poll();
+      };
+      xhr.send();
+    };
+    poll();
+  })();</script>
+</body></html>`))
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestInspectorDecodesBodies(t *testing.T) {
+	gz := func(s string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(s))
+		zw.Close()
+		return buf.Bytes()
+	}
+	big := "x" + strings.Repeat("é", inspectBodyLimit) // twice the limit, with a character split across it.
+	for _, c := range []struct {
+		name     string
+		encoding string
+		body     []byte
+		prefix   string
+		suffix   string
+	}{
+		{"plain", "", []byte(`{"ok": true}`), `{"ok": true}`, `{"ok": true}`},
+		{"gzip", "gzip", gz(`{"ok": true}`), `{"ok": true}`, `{"ok": true}`},
+		{"big gzip", "gzip", gz(big), "xééé", " bytes gzip total)"},
+		{"binary", "", []byte{0xff, 0xfe, 0}, "(3 bytes of binary data)", "(3 bytes of binary data)"},
+		{"unknown", "br", []byte{0xff, 0xfe, 0}, "(3 bytes br of binary data)", ""},
+	} {
+		in := NewInspector(4)
+		req, _ := http.NewRequest("GET", "http://upstream/", nil)
+		id := in.Begin(req, req)
+		rsp := &http.Response{StatusCode: 200, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewReader(c.body))}
+		if c.encoding != "" {
+			rsp.Header.Set("Content-Encoding", c.encoding)
+		}
+		in.Respond(id, rsp)
+		relayed, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if !bytes.Equal(relayed, c.body) {
+			t.Errorf("%v: relayed %q instead of %q", c.name, relayed, c.body)
+		}
+		_, exs := in.Since(req, 0, 0)
+		if len(exs) != 1 {
+			t.Fatalf("%v: expected one exchange, got %v", c.name, len(exs))
+		}
+		body := exs[0].RspBody
+		if !strings.HasPrefix(body, c.prefix) || !strings.HasSuffix(body, c.suffix) {
+			t.Errorf("%v: inspector shows %.60q...", c.name, body)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// listen is how a Server creates its listener, unless SetListen says otherwise.  Besides the usual TCP "host:port",
+// addr may be "unix:PATH" for a unix domain socket, or "systemd" or "systemd:NAME" to use a socket passed in by
+// systemd socket activation.
+func listen(addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return listenUnix(strings.TrimPrefix(addr, "unix:"))
+	case addr == "systemd":
+		return listenSystemd("")
+	case strings.HasPrefix(addr, "systemd:"):
+		return listenSystemd(strings.TrimPrefix(addr, "systemd:"))
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenUnix listens on a unix domain socket, replacing a socket file left behind by a process that is no longer
+// listening.  The socket file is removed when the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	fi, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	case fi.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("%v exists and is not a socket", path)
+	default:
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%v is in use by another process", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// listenSystemd finds a listener passed in by systemd, following sd_listen_fds(3); the first one is used if name is
+// empty.
+func listenSystemd(name string) (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets were passed in by systemd")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("no sockets were passed in by systemd")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < n; i++ {
+		fdName := ""
+		if i < len(names) {
+			fdName = names[i]
+		}
+		if name != "" && name != fdName {
+			continue
+		}
+		f := os.NewFile(uintptr(3+i), fdName)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+	return nil, fmt.Errorf("systemd did not pass in a socket named %#v", name)
+}
+
+// resolveBind turns "auto" and "HOST:auto" into addresses that let the operating system pick a free port.
+func resolveBind(bind string) string {
+	switch {
+	case bind == "auto":
+		return "127.0.0.1:0"
+	case strings.HasSuffix(bind, ":auto"):
+		return strings.TrimSuffix(bind, "auto") + "0"
+	}
+	return bind
+}
+
+// serviceURL describes where a browser can reach a listener at addr; unix sockets are described as "unix:PATH",
+// since browsers can't use them.
+func serviceURL(scheme string, addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr.Network() + ":" + addr.String()
+	}
+	host := tcp.IP.String()
+	if tcp.IP == nil || tcp.IP.IsUnspecified() {
+		host = "localhost"
+	}
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(tcp.Port))
+}
+
+// lanURLs lists URLs for reaching a listener at addr from elsewhere on the network, skipping loopback addresses;
+// a listener on an unspecified address is reachable on every interface.
+func lanURLs(scheme string, addr net.Addr) []string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	var ips []net.IP
+	if tcp.IP == nil || tcp.IP.IsUnspecified() {
+		ifaces, _ := net.Interfaces()
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			addrs, _ := iface.Addrs()
+			for _, a := range addrs {
+				ipn, ok := a.(*net.IPNet)
+				if !ok || ipn.IP.IsLinkLocalUnicast() {
+					continue // phones rarely manage link-local addresses with zones.
+				}
+				if ipn.IP.To4() == nil && tcp.IP != nil && tcp.IP.To4() != nil {
+					continue // listening on 0.0.0.0 only covers IPv4.
+				}
+				ips = append(ips, ipn.IP)
+			}
+		}
+	} else if !tcp.IP.IsLoopback() {
+		ips = append(ips, tcp.IP)
+	}
+
+	urls := make([]string, len(ips))
+	for i, ip := range ips {
+		urls[i] = scheme + "://" + net.JoinHostPort(ip.String(), strconv.Itoa(tcp.Port))
+	}
+	return urls
+}
+
+// openBrowser asks the desktop to open url in the default browser.
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
@@ -3,25 +3,52 @@ package main
 import (
 	"flag"
 	"fmt"
+	tarantula "github.com/swdunlop/tarantula-go"
 	"html/template"
-	"io"
 	"io/ioutil"
 	"log"
 	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
-	tarantula "github.com/swdunlop/tarantula-go"
 )
 
 func main() {
-	flag.StringVar(&cfg.Bind, `b`, `127.0.0.1:8080`, `HTTP server listen address`)
+	flag.StringVar(&cfg.Bind, `b`, `127.0.0.1:8080`, `HTTP server listen address, "auto" or "HOST:auto" for any free port, "unix:PATH" or "systemd[:NAME]"`)
+	flag.BoolVar(&cfg.Open, `o`, false, `open the page in the default browser once livefire is listening`)
+	flag.BoolVar(&cfg.TLS, `tls`, false, `serve HTTPS, with a certificate from a local CA unless -tls-cert is given`)
+	flag.StringVar(&cfg.TLSCert, `tls-cert`, ``, `PEM certificate for serving HTTPS`)
+	flag.StringVar(&cfg.TLSKey, `tls-key`, ``, `PEM key for -tls-cert, if it is not in the same file`)
+	flag.BoolVar(&cfg.Access.Token, `token`, false, `require browsers to log in through a one-time URL printed at startup`)
+	flag.StringVar(&cfg.Access.Basic, `basic`, ``, `USER:PASSWORD required through HTTP basic auth`)
+	flag.Var(&cfg.Access.Allow, `allow`, `CIDR of clients allowed to connect, besides loopback; may be repeated`)
 	flag.StringVar(&cfg.Title, `t`, `Live Fire Exercise`, `title for generated HTML page`)
-	flag.StringVar(&cfg.Fwd, `r`, ``, `URL backing any unrecognized paths`)
+	flag.Var(&cfg.Fwd, `r`, `URL backing any unrecognized paths, or PREFIX[:strip]=URL backing paths under PREFIX; may be repeated`)
+	flag.Var(&cfg.ReqHeaders, `req-header`, `"Name: value" to set or "-Name" to remove a header on forwarded requests; may be repeated`)
+	flag.Var(&cfg.RspHeaders, `rsp-header`, `"Name: value" to set or "-Name" to remove a header on forwarded responses; may be repeated`)
+	flag.BoolVar(&cfg.FixCookies, `fix-cookies`, false, `rewrite forwarded cookies to belong to livefire instead of the upstream`)
+	flag.BoolVar(&cfg.FixLocation, `fix-location`, false, `rewrite forwarded Location headers that point at the upstream to point at livefire`)
+	flag.StringVar(&cfg.Upstream.CA, `r-ca`, ``, `PEM file with extra CA certificates to trust for -r`)
+	flag.StringVar(&cfg.Upstream.Cert, `r-cert`, ``, `PEM client certificate to present to -r`)
+	flag.StringVar(&cfg.Upstream.Key, `r-key`, ``, `PEM client key for -r-cert, if it is not in the same file`)
+	flag.BoolVar(&cfg.Upstream.Insecure, `r-insecure`, false, `do not verify certificates presented by -r`)
+	flag.StringVar(&cfg.Upstream.ServerName, `r-server-name`, ``, `server name to send and verify for -r, instead of the URL's host; only allowed with a single https or wss -r`)
+	flag.DurationVar(&cfg.Upstream.Timeout, `r-timeout`, 0, `how long to wait for -r to connect and respond with headers`)
+	flag.StringVar(&cfg.Upstream.Proxy, `r-proxy`, ``, `http, https or socks5 proxy URL for reaching -r; defaults to $HTTPS_PROXY and friends`)
+	flag.Var(&cfg.Mocks, `m`, `JSON or YAML file declaring mock responses, which take priority over -r; may be repeated`)
+	flag.StringVar(&cfg.Record, `record`, ``, `HAR file to record forwarded requests and responses into`)
+	flag.StringVar(&cfg.Replay, `replay`, ``, `HAR file to answer forwarded requests from, instead of the upstream`)
+	flag.StringVar(&cfg.ReplayMatch, `replay-match`, `host,method,path,query`, `what must match for -replay to use a recorded response: some of host,method,path,query,body`)
+	flag.Var(&cfg.Faults, `fault`, `PREFIX=RULE,... to slow down or break responses under PREFIX; may be repeated`)
+	flag.IntVar(&cfg.Inspect, `inspect`, 100, `number of forwarded requests to keep for /.livefire/inspect`)
+	flag.BoolVar(&cfg.Inject, `i`, false, `inject the refresh shim into served and forwarded HTML pages`)
+	flag.BoolVar(&cfg.Mirror, `mirror`, false, `mirror scrolling, clicks, navigation and form input between connected browsers`)
 	flag.Usage = usage
 	flag.Parse()
 	err := livefireMain(flag.Args()...)
@@ -48,29 +75,199 @@ depends on the extension of the files provided on the command line:
     .css   wrapped with a <style> tag and placed in the <head>
     .html  placed verbatim in the <body>
     .js    wrapped with a <script> tag and placed in the <head>
+    .mjs   served as a file, and loaded with a <script type="module"> tag
     .*     served as a file with an autodetected MIME type
 
+A dot in the corner of the page shows whether livefire can be reached; if
+livefire restarts, pages keep trying to reconnect, and reload once it is back.
+
+Livefire usually listens on a TCP address, but -b unix:PATH will listen on a
+unix domain socket instead, and -b systemd uses a socket passed in by systemd
+socket activation; "systemd:NAME" picks one by its FileDescriptorName.
+
+When livefire listens where others can reach it, like 0.0.0.0, anyone can
+read the files it serves and use its -r forwards.  Use -allow to limit which
+networks may connect, -basic to require a password, or -token to require a
+login through a one-time URL; an authenticated browser can get another login
+URL for a second device from /.livefire/login/new.  Login URLs expire after
+five minutes, and livefire prints a new one when an old one is tried.
+Livefire's credentials are not forwarded to upstreams.
+
+To test on a phone or tablet, listen on 0.0.0.0 and open /.livefire/qr, which
+shows a QR code for each address livefire can be reached on from the network;
+with -token, each code includes a fresh login.
+
+When a file changes, pages get a "livefire:change" event whose detail has the
+file's path and url, before they reload; a page that can handle the change
+itself can call preventDefault() to keep its state:
+
+    document.addEventListener("livefire:change", function(ev) {
+        if (ev.detail.url === "/data.json") { ev.preventDefault(); refetch(); }
+    });
+
+ES modules, given as .mjs files, are replaced without reloading the page when
+they accept it, using an API like other bundlers': livefire sets
+import.meta.hot, and a module that calls import.meta.hot.accept(fn) is
+imported again when it changes, with fn given the new module.
+accept(url, fn) accepts changes to another module instead, dispose(fn) is
+called with a data object before the old module is replaced, and the new
+module finds that object in import.meta.hot.data.  Changes that no module
+accepts reload the page.  Modules imported by others must also be on the
+command line, so livefire serves and watches them.
+
+Files that should not reload pages at all can be given a mode by adding a
+suffix: "data.json:nowatch" is never watched, and "log.txt:notify-only" only
+sends the event.
+
+With -mirror, browsers showing livefire's pages follow each other: scrolling,
+clicks, navigation and form input in one tab are replayed in every other tab,
+which makes it easy to check a page on a desktop, phone and tablet at once.
+
+Browsers only offer some APIs, like service workers, to secure pages.  With
+-tls, livefire serves HTTPS, using a certificate issued by a CA it creates in
+your config directory; trust that CA's certificate in your browser to avoid
+warnings, or provide your own certificate with -tls-cert and -tls-key.
+
 URLs referencing JavaScript and CSS stylesheets can also be added to the
 command line, which will result in a reference in the generated HTML.  This
 makes it easier to include content from CDN's.
 
 Livefire can also be used as a reverse proxy for any files not provided on
 the command line.  This makes it easy to wrap an experimental HTML interface
-around another HTTP service.
+around another HTTP service.  WebSockets and event streams are passed through
+as they happen.  Several services can be combined by repeating -r with a path
+prefix; the longest matching prefix wins, and ":strip" removes the prefix
+before the request is forwarded:
+
+    -r http://localhost:8000 -r /api=http://localhost:9000 \
+    -r /auth:strip=http://localhost:9100
+
+Upstreams often assume they are talking to the browser directly.  The
+-fix-cookies and -fix-location flags move cookies and redirects from the
+upstream's origin to livefire's, and -req-header and -rsp-header add or remove
+headers, such as a Content-Security-Policy that would block the shim:
+
+    -rsp-header -Content-Security-Policy -req-header "Authorization: Bearer x"
+
+Internal upstreams may need a custom CA (-r-ca), a client certificate (-r-cert
+and -r-key), a different SNI name (-r-server-name) or to be reached through
+another proxy (-r-proxy); -r-insecure will trust any certificate.  These apply
+to every -r, so -r-server-name can only be used with a single TLS upstream.
+
+Responses can be mocked with -m, naming a JSON or YAML file that lists mock
+routes.  Mocks are matched before any -r forward, and both the file and any
+fixtures it refers to will trigger a refresh when they change:
+
+    - method: GET
+      path: /api/users/*
+      status: 200
+      headers: {"X-Mocked": "yes"}
+      file: fixtures/user.json
+      delay: 250ms
+    - path: /api/health
+      body: {"ok": true}
+
+Paths are matched like shell globs, and a path ending in /** matches anything
+beneath it.  Only a simple subset of YAML is understood.
+
+A session with the upstream can be captured with -record and played back
+later with -replay, which answers forwarded requests from the archive without
+contacting the upstream at all.  Requests recorded more than once are replayed
+in the order they were seen.  Event streams and bodies over 4 MiB are recorded
+without their content.  Replayed responses must come from the same upstream
+host, so forwards don't answer for each other; leave host out of -replay-match
+to replay a recording against a different upstream.
+
+Loading states and error handling can be exercised with -fault, which makes
+responses for paths under a prefix slow or unreliable.  Rules are latency and
+jitter durations, a rate in bytes per second, error and drop chances between
+0 and 1, and the status used for errors:
+
+    -fault /api=latency=500ms,jitter=1s,error=0.1,status=502
+    -fault /img=rate=20k,drop=0.05
+
+Faults can be switched off and on by POSTing to /.livefire/faults?enabled=0
+or 1, or replaced by POSTing a JSON list of rules, like those it returns.
+
+Recent forwarded requests, with their headers, timing and the start of their
+bodies, can be watched at /.livefire/inspect.
+
+/.livefire/ is a dashboard showing watched files and when they changed, the
+browsers waiting for changes, recent forwarded requests and errors, with
+buttons to reload browsers or pause reloading.  /.livefire/status describes
+the same things as JSON, waiting for something newer with ?since=SEQ.
+POSTing to /.livefire/status/reload reloads every browser, or just those
+matching its "client", "page" (a path prefix) and "agent" parameters,
+/.livefire/status/watch?paused=1 or 0 pauses or resumes reloading when files
+change, and /.livefire/status/files?add=PATH&remove=PATH serves and watches
+more files beneath the working directory, or stops serving some.  These, and
+the other /.livefire controls, turn away POSTs from pages on other sites.
+
+With -i, any text/html served by livefire, whether forwarded or read from a
+file, will have the refresh shim inserted before its closing </body> tag.
+Complete .html pages will also be served at their own path.
 `
 
 func livefireMain(args ...string) error {
 	var err error
 
-	svc := tarantula.NewService(cfg.Bind)
-	svc.Bind("/index.html", presentContent)
+	cfg.Bind = resolveBind(cfg.Bind)
+	svc := NewServer(cfg.Bind)
+	session.svc = svc
+	svc.Bind("/index.html", withFaults(presentContent))
 	svc.Bind("/.wait", waitForRefresh)
+	svc.Bind("/.livefire/inspect", presentInspector)
+	svc.Bind("/.livefire/inspect.json", listExchanges)
+	svc.Bind("/.livefire/faults", sameOrigin(controlFaults))
+	svc.Bind("/.livefire/login/new", newLogin)
+	svc.Bind("/.livefire/qr", presentQR)
+	svc.Bind("/.livefire/mirror", sameOrigin(publishMirror))
+	svc.Bind("/.livefire/", presentDashboard)
+	svc.Bind("/.livefire/status", presentStatus)
+	svc.Bind("/.livefire/status/reload", sameOrigin(controlReload))
+	svc.Bind("/.livefire/status/watch", sameOrigin(controlWatch))
+	svc.Bind("/.livefire/status/files", sameOrigin(controlFiles))
+	if cfg.Access.Enabled() {
+		svc.Guard(cfg.Access.guard)
+	}
+
+	inspector = NewInspector(cfg.Inspect)
+	err = cfg.Upstream.Check(cfg.Fwd)
+	if err != nil {
+		return err
+	}
+	cfg.transport, err = cfg.Upstream.Transport()
+	if err != nil {
+		return err
+	}
+	switch {
+	case cfg.Record != "" && cfg.Replay != "":
+		return fmt.Errorf(`cannot both record and replay`)
+	case cfg.Record != "":
+		cfg.record, err = OpenArchive(cfg.Record, cfg.ReplayMatch)
+	case cfg.Replay != "":
+		cfg.replay, err = OpenArchive(cfg.Replay, cfg.ReplayMatch)
+		if err == nil && len(cfg.replay.har.Log.Entries) == 0 {
+			err = fmt.Errorf(`%v has no recorded requests to replay`, cfg.Replay)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if cfg.record != nil {
+		defer cfg.record.Close()
+	}
 
 	for _, arg := range args {
 		u, err := url.Parse(arg)
 		if err != nil || u.Host == `` {
-			arg = filepath.Clean(arg)
-			bindFile(svc, arg)
+			file, mode := splitWatchMode(arg)
+			file = filepath.Clean(file)
+			err = bindFile(svc, file)
+			if err != nil {
+				return err
+			}
+			session.setWatchMode(file, mode)
 			continue
 		}
 		ext := path.Ext(u.Path)
@@ -84,109 +281,196 @@ func livefireMain(args ...string) error {
 		}
 	}
 
-	stalker, err := Stalk(cfg.Files...)
+	watched := append(session.WatchedFiles(), cfg.Mocks.Files()...)
+	changes, err := session.Watch(watched...)
+	if err != nil {
+		return err
+	}
+
+	root, err := bindForwards(svc, cfg.Fwd)
 	if err != nil {
 		return err
 	}
+	switch {
+	case root:
+	case len(cfg.Mocks) > 0:
+		svc.Bind("/", withFaults(mockOrRedirect))
+	default:
+		svc.BindRedirect("/", "/index.html")
+	}
 
-	if cfg.Fwd != "" {
-		cfg.fwdUrl, err = url.Parse(cfg.Fwd)
+	cfg.scheme = "http"
+	if cfg.TLS || cfg.TLSCert != "" {
+		tc, err := serverTLS()
 		if err != nil {
 			return err
 		}
-		svc.Bind("/", forwardRequest)
-	} else {
-		svc.BindRedirect("/", "/index.html")
+		svc.SetListen(tlsListen(tc, listen))
+		cfg.scheme = "https"
 	}
 
-	go processBrowsers(stalker)
+	go processBrowsers(changes)
 	err = svc.Start()
 	if err != nil {
 		return err
 	}
-	log.Println("ready to accept connections on http://" + cfg.Bind)
+	cfg.addr = svc.Addr()
+	addr := serviceURL(cfg.scheme, cfg.addr)
+	log.Println("ready to accept connections on " + addr)
+	for _, u := range lanURLs(cfg.scheme, cfg.addr) {
+		log.Println("also reachable on " + u)
+	}
+	page := addr + "/"
+	if cfg.Access.Token {
+		log.Println("log in at " + addr + cfg.Access.LoginURL())
+		page = addr + cfg.Access.LoginURL() // the one we printed is for someone else.
+	}
+	if cfg.Open {
+		if _, ok := svc.Addr().(*net.TCPAddr); !ok {
+			log.Println("cannot open a browser for", addr)
+		} else if err := openBrowser(page); err != nil {
+			log.Println("cannot open a browser:", err.Error())
+		}
+	}
 	return svc.Run()
 }
 
-func processBrowsers(stalker chan string) {
+func processBrowsers(changes chan string) {
 	ts := time.Now().Unix()
-
-	var pending []chan int64
+	changed := ts // when a watched file last changed, so pages from before then are stale.
+
+	var ml mirrorLog
+	waiting := make(map[string]Ticket) // by client
+	owed := make(map[string]bool)      // clients to reload when they next wait
+	heartbeats := time.NewTicker(heartbeatInterval / 4)
+	defer heartbeats.Stop()
+	reload := func() {
+		ts = time.Now().Unix()
+		for id, t := range waiting {
+			t.Result <- Notice{Time: ts, Seq: ml.seq}
+			delete(waiting, id)
+		}
+		owed = make(map[string]bool)
+	}
+	publish := func(ev MirrorEvent) {
+		ml.add(ev)
+		for id, t := range waiting {
+			if events := ml.since(t.Seq, t.Client); len(events) > 0 {
+				t.Result <- Notice{Time: ts, Seq: ml.seq, Events: events}
+				delete(waiting, id)
+			}
+		}
+	}
 	for {
 		select {
 		case t := <-browsers:
-			if t.Time < ts {
-				t.Result <- ts
+			stale := t.Time < ts || owed[t.Client]
+			if t.Seq < 0 {
+				stale = stale || t.Time < changed // it missed the change event while loading.
+				t.Seq = ml.seq                    // a new page only cares about what happens next.
+			} else {
+				stale = stale || ml.lost(t.Seq)
+			}
+			if stale {
+				delete(owed, t.Client)
+				t.Result <- Notice{Time: ts, Seq: ml.seq}
+			} else if events := ml.since(t.Seq, t.Client); len(events) > 0 {
+				t.Result <- Notice{Time: ts, Seq: ml.seq, Events: events}
 			} else {
-				pending = append(pending, t.Result)
+				t.arrived = time.Now()
+				waiting[t.Client] = t // replacing any earlier wait, which must have been abandoned.
 			}
-		case <-stalker:
-			ts = time.Now().Unix()
-			for _, p := range pending {
-				p <- ts
+		case now := <-heartbeats.C:
+			for id, t := range waiting {
+				if now.Sub(t.arrived) >= heartbeatInterval {
+					t.Result <- Notice{Time: ts, Seq: t.Seq, Heartbeat: true}
+					delete(waiting, id)
+				}
+			}
+		case t := <-abandoned:
+			if w, ok := waiting[t.Client]; ok && w.Result == t.Result {
+				delete(waiting, t.Client)
+			}
+		case ev := <-mirrors:
+			publish(ev)
+		case name := <-changes:
+			// Pages get a chance to handle changes themselves before the shim reloads them.
+			switch session.changed(name) {
+			case reloadChange:
+				changed = time.Now().Unix()
+				publish(session.changeEvent(name, true))
+			case notifyChange:
+				publish(session.changeEvent(name, false))
+			}
+		case r := <-reloads:
+			if r.Clients == nil {
+				log.Println("reloading browsers:", r.Reason)
+				reload()
+				break
+			}
+			log.Printf("reloading %v: %v", strings.Join(r.Clients, ", "), r.Reason)
+			for _, id := range r.Clients {
+				if t, ok := waiting[id]; ok {
+					t.Result <- Notice{Time: ts, Seq: ml.seq}
+					delete(waiting, id)
+				} else {
+					owed[id] = true // it's between waits.
+				}
 			}
-			pending = nil
-
 		}
+		session.setBrowsers(len(waiting))
 	}
 }
 
-func forwardRequest(req *http.Request) (interface{}, error) {
-	fwd := cfg.fwdUrl
-	req.URL.Host = fwd.Host
-	req.URL.Scheme = fwd.Scheme
-	req.URL.Path = fwd.Path + req.URL.Path
-	req.TLS = nil
-	req.RequestURI = ""
-
-	if req.URL.User == nil {
-		req.URL.User = fwd.User
-	}
-	if req.URL.Fragment == "" {
-		req.URL.Fragment = fwd.Fragment
-	}
-
-	log.Printf("forwarding to %#v", req.URL.String())
-
-	rsp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+func bindFile(svc *Server, file string) error {
+	if file == "" {
+		return nil // quit playin'..
 	}
-	return ProxyResponse{req, rsp}, nil
-}
-
-type ProxyResponse struct {
-	req *http.Request
-	rsp *http.Response
-}
 
-func (pr ProxyResponse) RespondToHttp(w http.ResponseWriter) error {
-	wh := w.Header()
-	for k, vv := range pr.rsp.Header {
-		for _, v := range vv {
-			wh.Add(k, v)
+	loc := fileRoute(file)
+	bind := false
+	if loc != "" {
+		var err error
+		bind, err = session.serve(file, loc)
+		if err != nil {
+			return err
 		}
 	}
-	w.WriteHeader(pr.rsp.StatusCode)
-	body := pr.rsp.Body
-	if body == nil {
+	session.mu.Lock()
+	session.files = append(session.files, file)
+	session.mu.Unlock()
+	if !bind {
 		return nil
 	}
-	defer body.Close()
-	_, err := io.Copy(w, body)
-	return err
-}
 
-func bindFile(svc *tarantula.Service, file string) {
-	if file == "" {
-		return // quit playin'..
-	}
+	content_type := mime.TypeByExtension(filepath.Ext(file))
+	log.Printf("serving %#v as %#v", file, loc)
+	svc.Bind(loc, withFaults(func(q *http.Request) (interface{}, error) {
+		file, ok := session.Served(loc)
+		if !ok {
+			return nil, tarantula.HttpError{Code: 404, Msg: "no longer served"}
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if isModule(file) {
+			data = withHot(data)
+		}
+		return byteContent{content_type, data}, nil
+	}))
+	return nil
+}
 
-	cfg.Files = append(cfg.Files, file)
-	ext := filepath.Ext(file)
-	switch ext {
-	case ".js", ".css", ".html":
-		return
+// fileRoute finds where file is served on its own, or "" if it is only included in index.html.
+func fileRoute(file string) string {
+	switch filepath.Ext(file) {
+	case ".js", ".css":
+		return ""
+	case ".html":
+		if !cfg.Inject {
+			return ""
+		}
 	}
 
 	// by default, the location is our path, with any stupid backslashes fixt.
@@ -207,16 +491,10 @@ func bindFile(svc *tarantula.Service, file string) {
 	if loc[0] != '/' {
 		loc = "/" + loc
 	}
-
-	content_type := mime.TypeByExtension(ext)
-	log.Printf("serving %#v as %#v", file, loc)
-	svc.Bind(loc, func(q *http.Request) (interface{}, error) {
-		data, err := ioutil.ReadFile(file)
-		if err != nil {
-			return nil, err
-		}
-		return byteContent{content_type, data}, nil
-	})
+	if loc == "/index.html" {
+		return "" // that's ours; it'll still be placed in the body.
+	}
+	return loc
 }
 
 type byteContent struct {
@@ -225,6 +503,9 @@ type byteContent struct {
 }
 
 func (bc byteContent) RespondToHttp(w http.ResponseWriter) error {
+	if cfg.Inject && isHTML(bc.Mime) {
+		bc.Data = injectShim(bc.Data)
+	}
 	h := w.Header()
 	h.Set("Content-type", bc.Mime)
 	h.Set("Content-length", fmt.Sprint(len(bc.Data)))
@@ -237,16 +518,22 @@ func (bc byteContent) RespondToHttp(w http.ResponseWriter) error {
 func presentContent(req *http.Request) (interface{}, error) {
 	doc := new(Content)
 	doc.Time = int64(time.Now().Unix())
+	doc.Client = newClientID()
 	doc.Cfg = &cfg
-	for _, f := range cfg.Files {
+	for _, f := range session.Files() {
 		err := doc.AddFile(f)
 		if err != nil {
-			log.Println(f, err.Error())
+			reportError(f, err)
 		}
 	}
 	return tarantula.WithTemplate{tmpl, doc}, nil
 }
 
+// Heartbeat is how often, in milliseconds, the shim can expect to hear from /.wait.
+func (doc *Content) Heartbeat() int64 {
+	return int64(heartbeatInterval / time.Millisecond)
+}
+
 func (doc *Content) AddFile(f string) error {
 	switch path.Ext(f) {
 	case ".js":
@@ -267,6 +554,8 @@ func (doc *Content) AddFile(f string) error {
 			return err
 		}
 		doc.HTML = append(doc.HTML, template.HTML(data))
+	case ".mjs":
+		doc.Modules = append(doc.Modules, fileRoute(f))
 	}
 
 	return nil
@@ -281,77 +570,399 @@ func waitForRefresh(req *http.Request) (interface{}, error) {
 	if err != nil {
 		return nil, tarantula.HttpError{400, err.Error()}
 	}
-	result := make(chan int64)
-	browsers <- Ticket{ts, result}
-	t2, ok := <-result
-	if !ok {
-		return nil, tarantula.HttpError{500, `turned away while waiting`}
+	seq := int64(-1)
+	if s := req.URL.Query().Get("seq"); s != "" {
+		seq, err = strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			return nil, tarantula.HttpError{Code: 400, Msg: err.Error()}
+		}
+	}
+	client := req.URL.Query().Get("client")
+	if client == "" {
+		client = req.RemoteAddr // an older shim.
+	}
+	session.seen(client, req)
+	result := make(chan Notice, 1) // so processBrowsers never waits on a browser that hung up.
+	ticket := Ticket{Time: ts, Seq: seq, Client: client, Result: result}
+	select {
+	case browsers <- ticket:
+	case <-req.Context().Done():
+		session.left(client, false)
+		return nil, req.Context().Err()
+	}
+	select {
+	case n, ok := <-result:
+		session.left(client, true)
+		if !ok {
+			return nil, tarantula.HttpError{500, `turned away while waiting`}
+		}
+		return n, nil
+	case <-req.Context().Done():
+		abandoned <- ticket
+		session.left(client, false)
+		return nil, req.Context().Err()
 	}
-	return t2, nil
 }
 
-var browsers = make(chan Ticket, 16)
+// browsers takes tickets to processBrowsers; it is unbuffered, so a ticket is always received before it can be
+// abandoned.
+var browsers = make(chan Ticket)
+
+// abandoned takes back tickets from browsers that hung up while waiting.
+var abandoned = make(chan Ticket, 16)
 
 type Ticket struct {
-	Time   int64
-	Result chan int64
+	Time    int64
+	Seq     int64  // of the last mirror event the browser has seen, or -1 if it has seen none
+	Client  string // ID of the page load, for targeted reloads, and so browsers don't get their own mirror events back
+	Result  chan Notice
+	arrived time.Time
 }
 
+// heartbeatInterval is how long a wait can go unanswered; browsers treat a quiet connection as a dead one.
+const heartbeatInterval = 20 * time.Second
+
 var cfg Config
 
 type Config struct {
-	Fwd   string
-	Bind  string
-	Title string
-	Files []string
-	CDN   struct {
+	Fwd         Forwards
+	Upstream    Upstream
+	FixCookies  bool
+	FixLocation bool
+	ReqHeaders  HeaderRules
+	RspHeaders  HeaderRules
+	Inspect     int
+	Mocks       Mocks
+	Record      string
+	Replay      string
+	ReplayMatch string
+	Faults      Faults
+	Bind        string
+	TLS         bool
+	TLSCert     string
+	TLSKey      string
+	Open        bool
+	Access      Access
+	Title       string
+	Inject      bool
+	Mirror      bool
+	CDN         struct {
 		CSS []template.URL
 		JS  []template.URL
 	}
-	fwdUrl *url.URL
+	transport *http.Transport
+	scheme    string // how browsers reach the listener at addr, once started
+	addr      net.Addr
+	record    *Archive
+	replay    *Archive
 }
 
 type Content struct {
-	Time int64
-	Cfg  *Config
-	CSS  []template.CSS
-	JS   []template.JS
-	HTML []template.HTML
+	Time    int64
+	Client  string // identifies this page load to /.wait
+	Cfg     *Config
+	CSS     []template.CSS
+	JS      []template.JS
+	Modules []string // routes of ES modules, which are loaded rather than included
+	HTML    []template.HTML
 }
 
 var tmpl = template.Must(template.New("root").Parse(`<html><head>{{if .Cfg.Title}}
   <title>{{.Cfg.Title}}</title>
-  <script>(function(){
+  {{template "shim" .}}
+{{end}}{{range .Cfg.CDN.CSS}}
+  <link rel="stylesheet" href="{{.}}" />
+{{end}}{{range .CSS}}
+  <style>{{.}}</style>
+{{end}}{{range .Cfg.CDN.JS}}
+  <script src="{{.}}"></script>
+{{end}}{{range .JS}}
+  <script>{{.}}</script>
+{{end}}{{range .Modules}}
+  <script type="module" src="{{.}}"></script>
+{{end}}</head><body>{{range .HTML}}
+  {{.}}
+{{end}}</body></html>{{define "shim"}}<script>(function(){
   	"use strict";
   	var getXHR = function() {
 	    if (window.XMLHttpRequest) return new XMLHttpRequest();
 	    if (window.ActiveXObject) return new ActiveXObject("MSXML2.XMLHTTP.3.0");
 	    return null;
   	};
-  	var watchHttp = function(){
+  	var client = {{.Client}} || Math.random().toString(36).slice(2);
+  	var pathOf = function(el) {
+  		var parts = [];
+  		while (el && el.nodeType === 1 && el !== document.body) {
+  			if (el.id) return ["#" + CSS.escape(el.id)].concat(parts).join(" > ");
+  			var n = 1;
+  			for (var sib = el.previousElementSibling; sib; sib = sib.previousElementSibling) n++;
+  			parts.unshift(el.tagName.toLowerCase() + ":nth-child(" + n + ")");
+  			el = el.parentElement;
+  		}
+  		return ["body"].concat(parts).join(" > ");
+  	};
+  	var find = function(path) {
+  		try {
+  			return document.querySelector(path);
+  		} catch (e) {
+  			return null;
+  		}
+  	};
+
+  	// Reloads keep the scroll position, focus and form fields, through session storage.
+  	var stateKey = "livefire:" + location.pathname + location.search;
+  	var saveState = function() {
+  		var state = {x: window.scrollX, y: window.scrollY, fields: []};
+  		var active = document.activeElement;
+  		if (active && active !== document.body) {
+  			state.focus = pathOf(active);
+  			try {
+  				state.selection = [active.selectionStart, active.selectionEnd];
+  			} catch (e) {}
+  		}
+  		var fields = document.querySelectorAll("input, textarea, select");
+  		for (var i = 0; i < fields.length; i++) {
+  			var el = fields[i];
+  			if (el.type === "password" || el.type === "file" || el.type === "hidden") continue;
+  			state.fields.push({path: pathOf(el), value: el.value, checked: !!el.checked});
+  		}
+  		try {
+  			sessionStorage.setItem(stateKey, JSON.stringify(state));
+  		} catch (e) {}
+  	};
+  	var restoreState = function() {
+  		var state = null;
+  		try {
+  			state = JSON.parse(sessionStorage.getItem(stateKey));
+  			sessionStorage.removeItem(stateKey);
+  		} catch (e) {}
+  		if (!state) return;
+  		for (var i = 0; i < state.fields.length; i++) {
+  			var f = state.fields[i], el = find(f.path);
+  			if (!el || !("value" in el)) continue;
+  			if (el.type === "checkbox" || el.type === "radio") {
+  				if (el.checked === f.checked) continue;
+  				el.checked = f.checked;
+  			} else {
+  				if (el.value === f.value) continue;
+  				el.value = f.value;
+  			}
+  			el.dispatchEvent(new Event("input", {bubbles: true}));
+  			el.dispatchEvent(new Event("change", {bubbles: true}));
+  		}
+  		var el = state.focus && find(state.focus);
+  		if (el && el.focus) {
+  			el.focus({preventScroll: true});
+  			try {
+  				if (state.selection) el.setSelectionRange(state.selection[0], state.selection[1]);
+  			} catch (e) {}
+  		}
+  		window.scrollTo(state.x, state.y);
+  	};
+  	var reload = function() {
+  		saveState();
+  		window.location.reload();
+  	};
+  	if (document.readyState === "complete") {
+  		restoreState();
+  	} else {
+  		window.addEventListener("load", restoreState); // once images have settled the layout.
+  	}
+{{if .Cfg.Mirror}}
+  	// Mirroring publishes what the user does here, and replays what they did in other tabs.  Replayed events are
+  	// not trusted, so they are not published again.
+  	var publish = function(ev) {
+  		var xhr = getXHR();
+  		xhr.open("POST", "/.livefire/mirror?client=" + client, true);
+  		xhr.setRequestHeader("Content-Type", "application/json");
+  		xhr.send(JSON.stringify(ev));
+  	};
+  	var here = function() { return location.pathname + location.search + location.hash; };
+  	var scrollRange = function() {
+  		var el = document.documentElement;
+  		return {x: Math.max(1, el.scrollWidth - window.innerWidth), y: Math.max(1, el.scrollHeight - window.innerHeight)};
+  	};
+  	var scrolled = {x: 0, y: 0}, scrollTimer = null;
+  	window.addEventListener("scroll", function() {
+  		if (scrollTimer) return;
+  		scrollTimer = window.setTimeout(function() {
+  			scrollTimer = null;
+  			var r = scrollRange(), x = window.scrollX / r.x, y = window.scrollY / r.y;
+  			if (Math.abs(x - scrolled.x) < 0.001 && Math.abs(y - scrolled.y) < 0.001) return; // we were told to.
+  			scrolled = {x: x, y: y};
+  			publish({type: "scroll", x: x, y: y});
+  		}, 100);
+  	});
+  	document.addEventListener("click", function(e) {
+  		if (e.isTrusted) publish({type: "click", path: pathOf(e.target)});
+  	}, true);
+  	var typed = function(e) {
+  		var el = e.target;
+  		if (!e.isTrusted || !("value" in el) || el.type === "password" || el.type === "file") return;
+  		publish({type: "input", path: pathOf(el), value: el.value, checked: !!el.checked});
+  	};
+  	document.addEventListener("input", typed, true);
+  	document.addEventListener("change", typed, true);
+  	var navigated = function() { publish({type: "nav", url: here()}); };
+  	window.addEventListener("hashchange", navigated);
+  	window.addEventListener("popstate", navigated);
+  	navigated();
+
+  	var mirror = function(events) {
+  		for (var i = 0; i < events.length; i++) {
+  			var ev = events[i], el = ev.path ? find(ev.path) : null;
+  			switch (ev.type) {
+  			case "scroll":
+  				var r = scrollRange();
+  				scrolled = {x: ev.x, y: ev.y};
+  				window.scrollTo(ev.x * r.x, ev.y * r.y);
+  				break;
+  			case "click":
+  				if (el) el.click();
+  				break;
+  			case "input":
+  				if (!el) break;
+  				el.value = ev.value;
+  				if ("checked" in el) el.checked = ev.checked;
+  				el.dispatchEvent(new Event("input", {bubbles: true}));
+  				el.dispatchEvent(new Event("change", {bubbles: true}));
+  				break;
+  			case "nav":
+  				if (ev.url !== here()) window.location.href = ev.url;
+  				break;
+  			}
+  		}
+  	};
+{{else}}
+  	var mirror = function(events) {};
+{{end}}
+  	// A dot in the corner shows whether livefire can be reached: green when it can, red while the shim tries to
+  	// reconnect, and amber while reloading.
+  	var indicator = null;
+  	var setState = function(state) {
+  		if (!document.body) return;
+  		if (!indicator) {
+  			indicator = document.createElement("div");
+  			indicator.id = "livefire-indicator";
+  			indicator.style.cssText = "position: fixed; right: 6px; bottom: 6px; width: 10px; height: 10px; " +
+  				"border-radius: 5px; box-shadow: 0 0 2px #000; opacity: 0.7; z-index: 2147483647";
+  			document.body.appendChild(indicator);
+  		}
+  		indicator.style.background = {connected: "#2a2", disconnected: "#d22", reloading: "#e90"}[state];
+  		indicator.title = "livefire: " + state;
+  	};
+
+  	// Hot module replacement: modules served by livefire start with import.meta.hot = livefire.hot(import.meta.url).
+  	// Changes to a module that something accepts import it again, with a fresh URL so the browser doesn't reuse the
+  	// old one, and hand it to the accept callbacks; modules it imports are not imported again, and keep their state.
+  	var hot = {accepts: {}, disposes: {}, data: {}, pending: {}};
+  	var routeOf = function(url, base) { return new URL(url, base || location.href).pathname; };
+  	window.livefire = window.livefire || {};
+  	window.livefire.hot = function(url) {
+  		var self = routeOf(url);
+  		// whatever an older version of this module registered is replaced by what this one registers.
+  		for (var route in hot.accepts) {
+  			hot.accepts[route] = hot.accepts[route].filter(function(a) { return a.owner !== self; });
+  		}
+  		delete hot.disposes[self];
+  		var data = hot.data[self] || {};
+  		delete hot.data[self];
+  		return {
+  			data: data,
+  			accept: function(dep, fn) {
+  				if (typeof dep !== "string") {
+  					fn = dep;
+  					dep = self;
+  				} else {
+  					dep = routeOf(dep, url);
+  				}
+  				(hot.accepts[dep] = hot.accepts[dep] || []).push({owner: self, fn: fn});
+  			},
+  			dispose: function(fn) { (hot.disposes[self] = hot.disposes[self] || []).push(fn); },
+  			invalidate: function() { setState("reloading"); reload(); }
+  		};
+  	};
+  	var importFresh = function(url) {
+  		// kept out of the shim's syntax, so browsers without import() can still reload.
+  		return new Function("url", "return import(url)")(url);
+  	};
+  	// update replaces the module at route, and reports whether anything accepted it.
+  	var update = function(route) {
+  		var accepts = hot.accepts[route];
+  		if (!route || !accepts || !accepts.length) return false;
+  		if (hot.pending[route]) return true; // saving a file is often several changes.
+  		hot.pending[route] = window.setTimeout(function() {
+  			delete hot.pending[route];
+  			var accepts = hot.accepts[route].slice(), data = {};
+  			(hot.disposes[route] || []).forEach(function(fn) { fn(data); });
+  			hot.data[route] = data;
+  			importFresh(route + "?livefire=" + Date.now()).then(function(mod) {
+  				console.log("livefire replaced " + route);
+  				accepts.forEach(function(a) { if (a.fn) a.fn(mod); });
+  			}).catch(function(err) {
+  				console.log("livefire could not replace " + route + ": " + err);
+  				setState("reloading");
+  				reload();
+  			});
+  		}, 50);
+  		return true;
+  	};
+
+  	// Changes to watched files arrive as events too, and are dispatched as livefire:change on the document; a page
+  	// that can handle a change itself, like refetching some JSON, calls preventDefault() to skip the reload.
+  	// notify reports whether the page should still reload.
+  	var notify = function(events) {
+  		var mirrored = [], stale = false;
+  		for (var i = 0; i < events.length; i++) {
+  			var ev = events[i];
+  			if (ev.type !== "change") {
+  				mirrored.push(ev);
+  				continue;
+  			}
+  			var change = new CustomEvent("livefire:change", {cancelable: true, detail: {path: ev.path, url: ev.url}});
+  			if (document.dispatchEvent(change) && ev.reload && !update(ev.url)) stale = true;
+  		}
+  		if (mirrored.length) mirror(mirrored);
+  		return stale;
+  	};
+
+  	var backoff = 0;
+  	var watchHttp = function(seq){
   		console.log("watching for change after " + {{.Time}});
   		var xhr = getXHR();
   		if (xhr == null) {
 	    	alert("Cannot determine how to get XHR.  Unable to autorefresh.")
 			return;  			
   		};
-  		xhr.open("GET", "/.wait?t=" + {{.Time}}, true);
+  		xhr.open("GET", "/.wait?t=" + {{.Time}} + "&seq=" + seq + "&client=" + client, true);
+  		xhr.timeout = 3 * {{.Heartbeat}}; // livefire answers at least this often, unless the connection is dead.
   		xhr.send();
   		xhr.onreadystatechange = function() {
   			if (xhr.readyState < 4) return; // don't care.
-  			window.location.reload();
+  			var notice = null;
+  			try {
+  				if (xhr.status === 200) notice = JSON.parse(xhr.responseText);
+  			} catch (e) {}
+  			if (!notice) {
+  				// livefire went away; keep trying, and it will tell us to reload when it is back.
+  				setState("disconnected");
+  				backoff = Math.min(backoff ? backoff * 2 : 500, 10000);
+  				window.setTimeout(function() { watchHttp(seq); }, backoff);
+  				return;
+  			}
+  			backoff = 0;
+  			setState("connected");
+  			if (notice.heartbeat) {
+  				watchHttp(notice.seq);
+  				return;
+  			}
+  			if (notice.events && !notify(notice.events)) {
+  				watchHttp(notice.seq);
+  				return;
+  			}
+  			setState("reloading");
+  			reload();
   		};
   	};
-  	window.setTimeout(watchHttp, 100); // Clear the throbber.
-  })();</script>
-{{end}}{{range .Cfg.CDN.CSS}}
-  <link rel="stylesheet" href="{{.}}" />
-{{end}}{{range .CSS}}
-  <style>{{.}}</style>
-{{end}}{{range .Cfg.CDN.JS}}
-  <script src="{{.}}"></script>
-{{end}}{{range .JS}}
-  <script>{{.}}</script>
-{{end}}</head><body>{{range .HTML}}
-  {{.}}
-{{end}}</body></html>`))
+  	window.setTimeout(function() { setState("connected"); watchHttp(-1); }, 100); // Clear the throbber.
+  })();</script>{{end}}`))
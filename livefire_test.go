@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestWaitForRefreshAbandoned connects and disconnects thousands of browsers, and checks that processBrowsers
+// forgets every one of them, and still answers the next.
+func TestWaitForRefreshAbandoned(t *testing.T) {
+	go processBrowsers(make(chan string))
+	time.Sleep(10 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+	future := time.Now().Unix() + 60 // so none of them are stale, and they all wait.
+
+	var wg sync.WaitGroup
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 2000; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5+rand.Intn(100))*time.Millisecond)
+				defer cancel()
+				// clients are reused across rounds, so some replace waits that are still being abandoned.
+				url := fmt.Sprintf("/.wait?t=%d&seq=-1&client=c%d", future, i%500)
+				_, err := waitForRefresh(httptest.NewRequest("GET", url, nil).WithContext(ctx))
+				if err == nil {
+					t.Errorf("client %v was answered", i)
+				}
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st := session.status()
+		n := runtime.NumGoroutine()
+		if st.Browsers == 0 && len(st.Clients) == 0 && n <= baseline {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v browsers waiting, %v clients, %v goroutines from %v", st.Browsers, len(st.Clients), n, baseline)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	answer := make(chan Notice, 1)
+	go func() {
+		url := fmt.Sprintf("/.wait?t=%d&seq=-1&client=fresh", future)
+		n, err := waitForRefresh(httptest.NewRequest("GET", url, nil))
+		if err != nil {
+			t.Errorf("fresh client: %v", err)
+			return
+		}
+		answer <- n.(Notice)
+	}()
+	for session.status().Browsers == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	requestReload("testing")
+	select {
+	case n := <-answer:
+		if n.Heartbeat || len(n.Events) > 0 {
+			t.Fatalf("expected a reload, got %#v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fresh client was not reloaded")
+	}
+}
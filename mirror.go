@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	tarantula "github.com/swdunlop/tarantula-go"
+)
+
+// MirrorEvent is something one browser did, like scrolling or typing, that the others should do too; Data is
+// interpreted by the shim, livefire just passes it along.  Livefire sends its own events the same way, like changes
+// to watched files.
+type MirrorEvent struct {
+	From string // client that published the event, which should not get it back; "" for livefire
+	Data json.RawMessage
+	seq  int64
+}
+
+// Notice answers a /.wait: with no events, and no heartbeat, the browser should reload.
+type Notice struct {
+	Time      int64             `json:"time"`
+	Seq       int64             `json:"seq"`
+	Events    []json.RawMessage `json:"events,omitempty"`
+	Heartbeat bool              `json:"heartbeat,omitempty"` // nothing happened, but livefire is still here
+}
+
+var mirrors = make(chan MirrorEvent, 16)
+
+// mirrorLogLimit is how many events are kept for browsers that are between waits.
+const mirrorLogLimit = 256
+
+// mirrorLog keeps recent mirror events for processBrowsers.
+type mirrorLog struct {
+	seq    int64 // of the last event added
+	events []MirrorEvent
+}
+
+func (ml *mirrorLog) add(ev MirrorEvent) {
+	ml.seq++
+	ev.seq = ml.seq
+	ml.events = append(ml.events, ev)
+	if len(ml.events) > mirrorLogLimit {
+		ml.events = append([]MirrorEvent{}, ml.events[len(ml.events)-mirrorLogLimit:]...)
+	}
+}
+
+// lost reports whether events after seq have been dropped to keep the log short.
+func (ml *mirrorLog) lost(seq int64) bool {
+	return len(ml.events) > 0 && ml.events[0].seq > seq+1
+}
+
+// since lists events after seq that did not come from client.
+func (ml *mirrorLog) since(seq int64, client string) []json.RawMessage {
+	var out []json.RawMessage
+	for _, ev := range ml.events {
+		if ev.seq > seq && ev.From != client {
+			out = append(out, ev.Data)
+		}
+	}
+	return out
+}
+
+// publishMirror accepts an event from a browser's shim at /.livefire/mirror, and hands it to processBrowsers.
+func publishMirror(req *http.Request) (interface{}, error) {
+	if !cfg.Mirror {
+		return nil, tarantula.HttpError{Code: 404, Msg: "mirroring is not enabled"}
+	}
+	if req.Method != "POST" {
+		return nil, tarantula.HttpError{Code: 405, Msg: "expected a POST of the event"}
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(data) {
+		return nil, tarantula.HttpError{Code: 400, Msg: "expected a JSON event"}
+	}
+	mirrors <- MirrorEvent{From: req.URL.Query().Get("client"), Data: data}
+	return true, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	tarantula "github.com/swdunlop/tarantula-go"
+)
+
+// Mock describes a canned response for requests matching Method and Path.  The body is either Body, verbatim if
+// it is a string or as JSON otherwise, or the contents of File, relative to the file declaring the mock.
+type Mock struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+	File    string            `json:"file"`
+	Delay   string            `json:"delay"`
+	dir     string
+}
+
+// Mocks lists files declaring mock routes; it implements flag.Value.  The files are read whenever a request
+// arrives, so they can be edited while livefire is running.
+type Mocks []string
+
+func (ms *Mocks) String() string {
+	if ms == nil {
+		return ""
+	}
+	return strings.Join(*ms, " ")
+}
+
+func (ms *Mocks) Set(arg string) error {
+	*ms = append(*ms, filepath.Clean(arg))
+	return nil
+}
+
+// Files lists the mock declarations and every fixture they refer to, so they can be stalked.
+func (ms Mocks) Files() []string {
+	var files []string
+	for _, file := range ms {
+		files = append(files, file)
+		mocks, err := loadMocks(file)
+		if err != nil {
+			reportError(file, err)
+			continue
+		}
+		for _, m := range mocks {
+			if m.File != "" {
+				files = append(files, m.file())
+			}
+		}
+	}
+	return files
+}
+
+// Match finds the first mock that matches req, or nil if none do.
+func (ms Mocks) Match(req *http.Request) *Mock {
+	for _, file := range ms {
+		mocks, err := loadMocks(file)
+		if err != nil {
+			reportError(file, err)
+			continue
+		}
+		for _, m := range mocks {
+			if m.matches(req) {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+// loadMocks reads a JSON or YAML file holding either a single mock or a list of them.
+func loadMocks(file string) ([]*Mock, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	switch filepath.Ext(file) {
+	case ".yaml", ".yml":
+		v, err := parseYAML(data)
+		if err != nil {
+			return nil, err
+		}
+		data, err = json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var mocks []*Mock
+	data = []byte(strings.TrimSpace(string(data)))
+	if len(data) > 0 && data[0] == '{' {
+		mocks = []*Mock{new(Mock)}
+		err = json.Unmarshal(data, mocks[0])
+	} else {
+		err = json.Unmarshal(data, &mocks)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(file)
+	for _, m := range mocks {
+		if m.Path == "" {
+			return nil, fmt.Errorf(`mock is missing a path`)
+		}
+		m.dir = dir
+	}
+	return mocks, nil
+}
+
+// matches checks the method and path of req; paths use path.Match patterns, and a pattern ending in "/**" matches
+// everything below it.
+func (m *Mock) matches(req *http.Request) bool {
+	if m.Method != "" && m.Method != "*" && !strings.EqualFold(m.Method, req.Method) {
+		return false
+	}
+	p := req.URL.Path
+	if strings.HasSuffix(m.Path, "/**") {
+		prefix := strings.TrimSuffix(m.Path, "**")
+		return p+"/" == prefix || strings.HasPrefix(p, prefix)
+	}
+	ok, err := path.Match(m.Path, p)
+	return ok && err == nil
+}
+
+func (m *Mock) file() string {
+	if filepath.IsAbs(m.File) {
+		return m.File
+	}
+	return filepath.Join(m.dir, m.File)
+}
+
+// respond waits out any delay, then produces the mock's response.
+func (m *Mock) respond(req *http.Request) (interface{}, error) {
+	if m.Delay != "" {
+		d, err := time.ParseDuration(m.Delay)
+		if err != nil {
+			return nil, fmt.Errorf(`bad delay for mock %v: %v`, m.Path, err)
+		}
+		select {
+		case <-time.After(d):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	mc := mockContent{Status: m.Status, Header: make(http.Header)}
+	if mc.Status == 0 {
+		mc.Status = 200
+	}
+	switch {
+	case m.File != "":
+		data, err := ioutil.ReadFile(m.file())
+		if err != nil {
+			return nil, tarantula.HttpError{Code: 500, Msg: err.Error()}
+		}
+		mc.Data = data
+		if ct := mime.TypeByExtension(filepath.Ext(m.File)); ct != "" {
+			mc.Header.Set("Content-Type", ct)
+		}
+	case len(m.Body) > 0 && m.Body[0] == '"':
+		var s string
+		json.Unmarshal(m.Body, &s)
+		mc.Data = []byte(s)
+		mc.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	case len(m.Body) > 0:
+		mc.Data = m.Body
+		mc.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range m.Headers {
+		mc.Header.Set(k, v)
+	}
+	log.Printf("mocking %v %v", req.Method, req.URL.Path)
+	return mc, nil
+}
+
+type mockContent struct {
+	Status int
+	Header http.Header
+	Data   []byte
+}
+
+func (mc mockContent) RespondToHttp(w http.ResponseWriter) error {
+	if cfg.Inject && isHTML(mc.Header.Get("Content-Type")) {
+		mc.Data = injectShim(mc.Data)
+	}
+	h := w.Header()
+	for k, vv := range mc.Header {
+		h[k] = vv
+	}
+	h.Set("Content-Length", fmt.Sprint(len(mc.Data)))
+	w.WriteHeader(mc.Status)
+	_, err := w.Write(mc.Data)
+	return err
+}
+
+// mockOrRedirect handles "/" when it is not forwarded, answering with mocks where they match.
+func mockOrRedirect(req *http.Request) (interface{}, error) {
+	if m := cfg.Mocks.Match(req); m != nil {
+		return m.respond(req)
+	}
+	return tarantula.ForwardToURL{URL: "/index.html"}, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// Forward describes an upstream service backing every path under Prefix.
+type Forward struct {
+	Prefix string
+	URL    *url.URL
+	Strip  bool // remove Prefix from the path before forwarding
+	proxy  *httputil.ReverseProxy
+}
+
+// Forwards collects -r options; it implements flag.Value.
+type Forwards []*Forward
+
+func (fs *Forwards) String() string {
+	if fs == nil {
+		return ""
+	}
+	ss := make([]string, len(*fs))
+	for i, f := range *fs {
+		ss[i] = f.String()
+	}
+	return strings.Join(ss, " ")
+}
+
+// Set parses either a bare URL, which backs "/", or PREFIX[:strip]=URL.
+func (fs *Forwards) Set(arg string) error {
+	f := &Forward{Prefix: "/"}
+	raw := arg
+	if strings.HasPrefix(arg, "/") {
+		i := strings.Index(arg, "=")
+		if i < 0 {
+			return fmt.Errorf(`expected PREFIX=URL, got %#v`, arg)
+		}
+		f.Prefix, raw = arg[:i], arg[i+1:]
+		if strings.HasSuffix(f.Prefix, ":strip") {
+			f.Prefix = strings.TrimSuffix(f.Prefix, ":strip")
+			f.Strip = true
+		}
+		f.Prefix = "/" + strings.Trim(f.Prefix, "/")
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf(`%#v does not name a host`, raw)
+	}
+	for _, f2 := range *fs {
+		if f2.Prefix == f.Prefix {
+			return fmt.Errorf(`%v is already forwarded to %v`, f.Prefix, f2.URL)
+		}
+	}
+	f.URL = u
+	f.proxy = newProxy(f)
+	*fs = append(*fs, f)
+	return nil
+}
+
+func (f *Forward) String() string {
+	prefix := f.Prefix
+	if f.Strip {
+		prefix += ":strip"
+	}
+	return prefix + "=" + f.URL.String()
+}
+
+// patterns lists the routes a forward is bound to.
+func (f *Forward) patterns() []string {
+	if f.Prefix == "/" {
+		return []string{"/"}
+	}
+	return []string{f.Prefix, f.Prefix + "/"}
+}
+
+// bindForwards attaches each forward to its prefix, relying on the mux to prefer the longest match.  It reports
+// whether one of them claimed "/", and fails if a prefix is already routed to something else, like a file or
+// livefire's own pages.
+func bindForwards(svc *Server, fs Forwards) (bool, error) {
+	routed := make(map[string]bool)
+	for _, r := range svc.Routes() {
+		routed[r] = true
+	}
+	for _, f := range fs {
+		for _, p := range f.patterns() {
+			if routed[p] {
+				return false, fmt.Errorf(`cannot forward %v, livefire already serves %v`, f.Prefix, p)
+			}
+		}
+	}
+
+	root := false
+	for _, f := range fs {
+		log.Printf("forwarding %#v to %#v", f.Prefix, f.URL.String())
+		if f.Prefix == "/" {
+			root = true
+		}
+		for _, p := range f.patterns() {
+			svc.Bind(p, withFaults(f.forwardRequest))
+		}
+	}
+	return root, nil
+}
+
+// newProxy constructs the reverse proxy used for requests livefire doesn't recognize.  Hop-by-hop headers are
+// dropped, X-Forwarded-* is set, paths and queries are joined with the target's, and redirects are handed to the
+// browser instead of being followed.  Connection upgrades, like WebSockets, are relayed, and every write from the
+// upstream is flushed to the browser so event streams aren't held up in a buffer.
+func newProxy(f *Forward) *httputil.ReverseProxy {
+	t := *f.URL // a copy, so the forward still shows what the user asked for.
+	target := &t
+	switch target.Scheme {
+	case "ws":
+		target.Scheme = "http"
+	case "wss":
+		target.Scheme = "https"
+	}
+	return &httputil.ReverseProxy{
+		FlushInterval: -1,
+		Transport:     forwardTransport{},
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			if f.Strip {
+				stripPrefix(pr.Out.URL, f.Prefix)
+			}
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			if target.User != nil {
+				pr.Out.URL.User = target.User
+			}
+			cfg.Access.stripCredentials(pr.Out.Header)
+			cfg.ReqHeaders.Apply(pr.Out.Header)
+			switch {
+			case cfg.record != nil:
+				pr.Out.Header.Del("Accept-Encoding") // so the transport decodes responses before we record them.
+			case cfg.Inject && pr.Out.Header.Get("Accept-Encoding") != "":
+				pr.Out.Header.Set("Accept-Encoding", "gzip, deflate") // so we can decode pages to inject the shim.
+			}
+			log.Printf("forwarding to %#v", pr.Out.URL.String())
+			pr.Out = withProxied(pr.Out, &proxied{pr.In, inspector.Begin(pr.In, pr.Out)})
+		},
+		ModifyResponse: func(rsp *http.Response) error {
+			p := proxiedFrom(rsp.Request)
+			inspector.Respond(p.id, rsp)
+			f.rewriteResponse(rsp)
+			if cfg.Inject && isHTML(rsp.Header.Get("Content-Type")) {
+				return injectProxyResponse(rsp)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, out *http.Request, err error) {
+			inspector.Fail(proxiedFrom(out).id, err)
+			reportError("forwarding to "+out.URL.String(), err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// forwardTransport sends forwarded requests to the upstream, recording them if asked, unless we are replaying an
+// archive instead.
+type forwardTransport struct{}
+
+func (forwardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case cfg.replay != nil:
+		return cfg.replay.Replay(req)
+	case cfg.record != nil:
+		return cfg.record.Record(req, cfg.transport)
+	}
+	return cfg.transport.RoundTrip(req)
+}
+
+// stripPrefix removes prefix from the path of u, keeping it rooted.
+func stripPrefix(u *url.URL, prefix string) {
+	u.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(u.Path, prefix), "/")
+	if u.RawPath != "" {
+		u.RawPath = "/" + strings.TrimPrefix(strings.TrimPrefix(u.RawPath, prefix), "/")
+	}
+}
+
+func (f *Forward) forwardRequest(req *http.Request) (interface{}, error) {
+	if m := cfg.Mocks.Match(req); m != nil {
+		return m.respond(req)
+	}
+	return ProxyResponse{req, f.proxy}, nil
+}
+
+// ProxyResponse relays a request to the upstream service when tarantula asks it to respond.
+type ProxyResponse struct {
+	req   *http.Request
+	proxy *httputil.ReverseProxy
+}
+
+func (pr ProxyResponse) RespondToHttp(w http.ResponseWriter) error {
+	pr.proxy.ServeHTTP(w, pr.req)
+	return nil
+}
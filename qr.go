@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	tarantula "github.com/swdunlop/tarantula-go"
+)
+
+// QR is a QR code, as a square of modules where true is dark.
+type QR [][]bool
+
+// qrBlocks describes error correction level M for each version: EC codewords per block, then the count and data
+// codewords of each group of blocks.
+var qrBlocks = []struct {
+	ec             int
+	n1, d1, n2, d2 int
+}{
+	{}, // there is no version 0
+	{10, 1, 16, 0, 0},
+	{16, 1, 28, 0, 0},
+	{26, 1, 44, 0, 0},
+	{18, 2, 32, 0, 0},
+	{24, 2, 43, 0, 0},
+	{16, 4, 27, 0, 0},
+	{18, 4, 31, 0, 0},
+	{22, 2, 38, 2, 39},
+	{22, 3, 36, 2, 37},
+	{26, 4, 43, 1, 44},
+}
+
+// EncodeQR encodes data in byte mode with medium error correction, using the smallest version that fits, up to
+// version 10, which holds 213 bytes.
+func EncodeQR(data []byte) (QR, error) {
+	version := 0
+	for v := 1; v < len(qrBlocks); v++ {
+		b := qrBlocks[v]
+		capacity := b.n1*b.d1 + b.n2*b.d2
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*capacity {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errors.New("too much data for a QR code")
+	}
+
+	codewords := qrCodewords(version, data)
+	qb := newQRBuilder(version)
+	qb.placeData(codewords)
+
+	best, bestPenalty := -1, 0
+	for mask := 0; mask < 8; mask++ {
+		qb.applyMask(mask)
+		qb.drawFormat(mask)
+		p := qb.penalty()
+		if best < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		qb.applyMask(mask) // masks are their own inverse.
+	}
+	qb.applyMask(best)
+	qb.drawFormat(best)
+	return qb.modules, nil
+}
+
+// qrCodewords builds the data codewords for version, then interleaves them with their error correction.
+func qrCodewords(version int, data []byte) []byte {
+	b := qrBlocks[version]
+	capacity := b.n1*b.d1 + b.n2*b.d2
+
+	var bits qrBits
+	bits.append(0x4, 4) // byte mode
+	if version >= 10 {
+		bits.append(len(data), 16)
+	} else {
+		bits.append(len(data), 8)
+	}
+	for _, c := range data {
+		bits.append(int(c), 8)
+	}
+	for i := 0; i < 4 && len(bits) < capacity*8; i++ {
+		bits = append(bits, false) // terminator
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	for pad := 0; len(bits) < capacity*8; pad ^= 1 {
+		bits.append([]int{0xEC, 0x11}[pad], 8)
+	}
+	words := bits.bytes()
+
+	var blocks, ecs [][]byte
+	divisor := rsDivisor(b.ec)
+	for i := 0; i < b.n1+b.n2; i++ {
+		n := b.d1
+		if i >= b.n1 {
+			n = b.d2
+		}
+		blocks = append(blocks, words[:n])
+		ecs = append(ecs, rsRemainder(words[:n], divisor))
+		words = words[n:]
+	}
+
+	var out []byte
+	for i := 0; i < b.d1 || i < b.d2; i++ {
+		for _, blk := range blocks {
+			if i < len(blk) {
+				out = append(out, blk[i])
+			}
+		}
+	}
+	for i := 0; i < b.ec; i++ {
+		for _, ec := range ecs {
+			out = append(out, ec[i])
+		}
+	}
+	return out
+}
+
+type qrBits []bool
+
+func (qb *qrBits) append(val, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*qb = append(*qb, (val>>uint(i))&1 != 0)
+	}
+}
+
+func (qb qrBits) bytes() []byte {
+	out := make([]byte, len(qb)/8)
+	for i, b := range qb {
+		if b {
+			out[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return out
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor computes the Reed-Solomon generator polynomial of the given degree, leading term omitted.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	var root byte = 1
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMul(d, factor)
+		}
+	}
+	return result
+}
+
+// qrBuilder tracks which modules belong to function patterns while the code is drawn.
+type qrBuilder struct {
+	version  int
+	size     int
+	modules  QR
+	function [][]bool
+}
+
+func newQRBuilder(version int) *qrBuilder {
+	size := version*4 + 17
+	qb := &qrBuilder{version: version, size: size}
+	qb.modules = make(QR, size)
+	qb.function = make([][]bool, size)
+	for i := range qb.modules {
+		qb.modules[i] = make([]bool, size)
+		qb.function[i] = make([]bool, size)
+	}
+
+	for i := 0; i < size; i++ {
+		qb.set(6, i, i%2 == 0) // timing patterns
+		qb.set(i, 6, i%2 == 0)
+	}
+	qb.finder(3, 3)
+	qb.finder(size-4, 3)
+	qb.finder(3, size-4)
+
+	if version > 1 {
+		pos := qrAlignment(version)
+		for _, x := range pos {
+			for _, y := range pos {
+				if (x == 6 && y == 6) || (x == 6 && y == size-7) || (x == size-7 && y == 6) {
+					continue // those are finders.
+				}
+				for dy := -2; dy <= 2; dy++ {
+					for dx := -2; dx <= 2; dx++ {
+						qb.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+					}
+				}
+			}
+		}
+	}
+
+	qb.drawFormat(0) // reserves the format areas, and the dark module.
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			bit := (bits>>uint(i))&1 != 0
+			a, b := size-11+i%3, i/3
+			qb.set(a, b, bit)
+			qb.set(b, a, bit)
+		}
+	}
+	return qb
+}
+
+// set draws a function module at column x, row y.
+func (qb *qrBuilder) set(x, y int, dark bool) {
+	qb.modules[y][x] = dark
+	qb.function[y][x] = true
+}
+
+// finder draws a finder pattern and its separator centered on x, y.
+func (qb *qrBuilder) finder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= qb.size || yy >= qb.size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			qb.set(xx, yy, d != 2 && d != 4)
+		}
+	}
+}
+
+// qrAlignment lists the alignment pattern centers for version.
+func qrAlignment(version int) []int {
+	last := version*4 + 10
+	if version < 7 {
+		return []int{6, last}
+	}
+	return []int{6, (6 + last) / 2, last} // good through version 13.
+}
+
+func (qb *qrBuilder) drawFormat(mask int) {
+	data := 0<<3 | mask // level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		qb.set(8, i, bit(i))
+	}
+	qb.set(8, 7, bit(6))
+	qb.set(8, 8, bit(7))
+	qb.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qb.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		qb.set(qb.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qb.set(8, qb.size-15+i, bit(i))
+	}
+	qb.set(8, qb.size-8, true)
+}
+
+// placeData zigzags codewords through the modules that are not part of a function pattern.
+func (qb *qrBuilder) placeData(data []byte) {
+	i := 0
+	for right := qb.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < qb.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = qb.size - 1 - vert
+				}
+				if !qb.function[y][x] && i < len(data)*8 {
+					qb.modules[y][x] = (data[i/8]>>uint(7-i%8))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (qb *qrBuilder) applyMask(mask int) {
+	for y := 0; y < qb.size; y++ {
+		for x := 0; x < qb.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !qb.function[y][x] {
+				qb.modules[y][x] = !qb.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code will be to scan, following the four rules of the standard.
+func (qb *qrBuilder) penalty() int {
+	n := qb.size
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return qb.modules[x][y]
+		}
+		return qb.modules[y][x]
+	}
+	finderA := []bool{true, false, true, true, true, false, true, false, false, false, false}
+	finderB := []bool{false, false, false, false, true, false, true, true, true, false, true}
+
+	score := 0
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < n; y++ {
+			run := 1
+			for x := 1; x <= n; x++ {
+				if x < n && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += run - 2
+				}
+				run = 1
+			}
+			for x := 0; x+len(finderA) <= n; x++ {
+				a, b := true, true
+				for k := range finderA {
+					m := at(x+k, y, transpose)
+					a = a && m == finderA[k]
+					b = b && m == finderB[k]
+				}
+				if a || b {
+					score += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if qb.modules[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				m := qb.modules[y][x]
+				if m == qb.modules[y][x+1] && m == qb.modules[y+1][x] && m == qb.modules[y+1][x+1] {
+					score += 3
+				}
+			}
+		}
+	}
+	percent := dark * 100 / (n * n)
+	score += abs(percent-50) / 5 * 10
+	return score
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// SVG renders the code with a quiet zone, scaled to fit the viewport of whatever contains it.
+func (qr QR) SVG() template.HTML {
+	var buf bytes.Buffer
+	n := len(qr) + 8
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, n, n)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+	for y, row := range qr {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+4, y+4)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return template.HTML(buf.String())
+}
+
+type qrPage struct {
+	Title string
+	Codes []qrCode
+	Note  string
+}
+
+type qrCode struct {
+	URL string
+	SVG template.HTML
+}
+
+// presentQR shows a QR code for each address a device on the network could use to reach livefire.
+func presentQR(req *http.Request) (interface{}, error) {
+	page := qrPage{Title: cfg.Title}
+	urls := lanURLs(cfg.scheme, cfg.addr)
+	if len(urls) == 0 {
+		page.Note = "Livefire is only listening on loopback; bind to 0.0.0.0 to test from other devices."
+	}
+	for _, u := range urls {
+		if cfg.Access.Token {
+			u += cfg.Access.LoginURL()
+		} else {
+			u += "/"
+		}
+		qr, err := EncodeQR([]byte(u))
+		if err != nil {
+			return nil, err
+		}
+		page.Codes = append(page.Codes, qrCode{u, qr.SVG()})
+	}
+	return tarantula.WithTemplate{Tmpl: qrTmpl, Data: &page}, nil
+}
+
+var qrTmpl = template.Must(template.New("qr").Parse(`<html><head>
+  <title>{{.Title}} - QR Codes</title>
+  <style>
+    body { font-family: sans-serif; }
+    .code { display: inline-block; margin: 1em; text-align: center; }
+    .code svg { width: 280px; height: 280px; }
+    .code a { display: block; font-size: 13px; word-break: break-all; max-width: 280px; }
+  </style>
+</head><body>
+  {{if .Note}}<p>{{.Note}}</p>{{end}}
+  {{range .Codes}}<div class="code">{{.SVG}}<a href="{{.URL}}">{{.URL}}</a></div>
+  {{end}}
+</body></html>`))
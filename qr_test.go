@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// The Reed-Solomon example from the well known "HELLO WORLD" 1-M walkthrough.
+func TestQRReedSolomon(t *testing.T) {
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	expect := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	ec := rsRemainder(data, rsDivisor(len(expect)))
+	if !bytes.Equal(ec, expect) {
+		t.Fatalf("got %v, expected %v", ec, expect)
+	}
+}
+
+// qrFormatM is the format information for level M with each mask, from the QR specification's table.
+var qrFormatM = []string{
+	"101010000010010", "101000100100101", "101111001111100", "101101101001011",
+	"100010111111001", "100000011001110", "100111110010111", "100101010100000",
+}
+
+func TestQRFormat(t *testing.T) {
+	for mask, expect := range qrFormatM {
+		qb := newQRBuilder(1)
+		qb.drawFormat(mask)
+		// bits 0 to 7 run right to left below the top-right finder, and 8 to 14 run down beside the bottom-left one.
+		var got []byte
+		for i := 14; i >= 0; i-- {
+			var dark bool
+			if i < 8 {
+				dark = qb.modules[8][qb.size-1-i]
+			} else {
+				dark = qb.modules[qb.size-15+i][8]
+			}
+			got = append(got, "01"[b2i(dark)])
+		}
+		if string(got) != expect {
+			t.Errorf("mask %v: got %s, expected %v", mask, got, expect)
+		}
+	}
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// qrVersionInfo is the version information for versions 7 through 10, from the specification's table.
+var qrVersionInfo = map[int]string{
+	7:  "000111110010010100",
+	8:  "001000010110111100",
+	9:  "001001101010011001",
+	10: "001010010011010011",
+}
+
+// qrAlignmentSpec lists alignment pattern centers, from the specification's table.
+var qrAlignmentSpec = map[int][]int{
+	2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30}, 6: {6, 34},
+	7: {6, 22, 38}, 8: {6, 24, 42}, 9: {6, 26, 46}, 10: {6, 28, 50},
+}
+
+// qrLayoutM gives the total codewords, EC codewords per block and blocks for level M, from the specification.
+var qrLayoutM = map[int][3]int{
+	1: {26, 10, 1}, 2: {44, 16, 1}, 3: {70, 26, 1}, 4: {100, 18, 2}, 5: {134, 24, 2},
+	6: {172, 16, 4}, 7: {196, 18, 4}, 8: {242, 22, 4}, 9: {292, 22, 5}, 10: {346, 26, 5},
+}
+
+// TestQRDecode decodes codes of every version independently of the encoder: it checks the function patterns,
+// format and version information against the specification, removes the mask the format names, reads the
+// codewords back, checks every block's error correction, and compares the payload.
+func TestQRDecode(t *testing.T) {
+	sizes := []int{0, 1, 14, 15, 26, 42, 62, 84, 106, 122, 152, 180, 213}
+	for _, n := range sizes {
+		data := []byte(strings.Repeat("https://192.168.1.20:8080/.livefire/login?code=", 5)[:n])
+		qr, err := EncodeQR(data)
+		if err != nil {
+			t.Fatalf("%v bytes: %v", n, err)
+		}
+		out, err := decodeQR(qr)
+		if err != nil {
+			t.Errorf("%v bytes: %v", n, err)
+			continue
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("%v bytes: decoded %q", n, out)
+		}
+	}
+	if _, err := EncodeQR(make([]byte, 214)); err == nil {
+		t.Errorf("expected 214 bytes to be too much")
+	}
+}
+
+func decodeQR(qr QR) ([]byte, error) {
+	size := len(qr)
+	version := (size - 17) / 4
+	layout, ok := qrLayoutM[version]
+	if !ok || size != version*4+17 {
+		return nil, fmt.Errorf("unexpected size %v", size)
+	}
+	for _, row := range qr {
+		if len(row) != size {
+			return nil, fmt.Errorf("not square")
+		}
+	}
+	at := func(x, y int) bool { return qr[y][x] }
+	function := make([][]bool, size)
+	for i := range function {
+		function[i] = make([]bool, size)
+	}
+	var problems []string
+	expect := func(x, y int, dark bool, what string) {
+		function[y][x] = true
+		if at(x, y) != dark {
+			problems = append(problems, fmt.Sprintf("%v at %v,%v", what, x, y))
+		}
+	}
+
+	// finders, their separators, and the timing patterns.
+	for _, c := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || y < 0 || x >= size || y >= size {
+					continue
+				}
+				d := max(abs(dx), abs(dy))
+				expect(x, y, d <= 1 || d == 3, "finder")
+			}
+		}
+	}
+	for i := 8; i < size-8; i++ {
+		expect(i, 6, i%2 == 0, "timing")
+		expect(6, i, i%2 == 0, "timing")
+	}
+	pos := qrAlignmentSpec[version]
+	last := size - 7
+	for _, x := range pos {
+		for _, y := range pos {
+			if (x == 6 && y == 6) || (x == 6 && y == last) || (x == last && y == 6) {
+				continue // those would overlap the finders.
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					d := max(abs(dx), abs(dy))
+					expect(x+dx, y+dy, d != 1, "alignment")
+				}
+			}
+		}
+	}
+	expect(8, size-8, true, "dark module")
+
+	// format information, in both copies.
+	var first, second [15]bool
+	for i := 0; i <= 5; i++ {
+		first[i] = at(8, i)
+	}
+	first[6], first[7], first[8] = at(8, 7), at(8, 8), at(7, 8)
+	for i := 9; i < 15; i++ {
+		first[i] = at(14-i, 8)
+	}
+	for i := 0; i < 8; i++ {
+		second[i] = at(size-1-i, 8)
+	}
+	for i := 8; i < 15; i++ {
+		second[i] = at(8, size-15+i)
+	}
+	mark := func(x, y int) { function[y][x] = true }
+	for i := 0; i <= 8; i++ {
+		mark(8, i)
+		mark(i, 8)
+	}
+	for i := 0; i < 8; i++ {
+		mark(size-1-i, 8)
+		mark(8, size-1-i)
+	}
+	if first != second {
+		problems = append(problems, "format copies differ")
+	}
+	mask := -1
+	for m, f := range qrFormatM {
+		match := true
+		for i := 0; i < 15; i++ {
+			match = match && first[i] == (f[14-i] == '1')
+		}
+		if match {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		problems = append(problems, "format is not level M")
+	}
+
+	if info, ok := qrVersionInfo[version]; ok {
+		for i := 0; i < 18; i++ {
+			a, b := size-11+i%3, i/3
+			expect(a, b, info[17-i] == '1', "version")
+			expect(b, a, info[17-i] == '1', "version")
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%v", strings.Join(problems, "; "))
+	}
+
+	// read the codewords back, undoing the mask.
+	masks := []func(x, y int) bool{
+		func(x, y int) bool { return (x+y)%2 == 0 },
+		func(x, y int) bool { return y%2 == 0 },
+		func(x, y int) bool { return x%3 == 0 },
+		func(x, y int) bool { return (x+y)%3 == 0 },
+		func(x, y int) bool { return (y/2+x/3)%2 == 0 },
+		func(x, y int) bool { return x*y%2+x*y%3 == 0 },
+		func(x, y int) bool { return (x*y%2+x*y%3)%2 == 0 },
+		func(x, y int) bool { return ((x+y)%2+x*y%3)%2 == 0 },
+	}
+	total, ec, blocks := layout[0], layout[1], layout[2]
+	codewords := make([]byte, total)
+	n := 0
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = size - 1 - vert
+				}
+				if function[y][x] || n >= total*8 {
+					continue
+				}
+				if at(x, y) != masks[mask](x, y) {
+					codewords[n/8] |= 0x80 >> uint(n%8)
+				}
+				n++
+			}
+		}
+	}
+
+	// de-interleave the blocks, with the short ones first, and check their error correction.
+	short := blocks - total%blocks
+	shortData := total/blocks - ec
+	block := make([][]byte, blocks)
+	k := 0
+	for i := 0; i < shortData+1; i++ {
+		for b := range block {
+			if i < shortData || b >= short {
+				block[b] = append(block[b], codewords[k])
+				k++
+			}
+		}
+	}
+	var data []byte
+	for _, b := range block {
+		data = append(data, b...)
+	}
+	for i := 0; i < ec; i++ {
+		for b := range block {
+			block[b] = append(block[b], codewords[k])
+			k++
+		}
+	}
+	for b, cw := range block {
+		if !qrSyndromesZero(cw, ec) {
+			return nil, fmt.Errorf("block %v fails its error correction", b)
+		}
+	}
+
+	// byte mode, with an 8 bit count through version 9 and 16 bits after.
+	bit := func(i int) int { return int(data[i/8]>>uint(7-i%8)) & 1 }
+	read := func(at, n int) int {
+		v := 0
+		for i := 0; i < n; i++ {
+			v = v<<1 | bit(at+i)
+		}
+		return v
+	}
+	if read(0, 4) != 4 {
+		return nil, fmt.Errorf("expected byte mode")
+	}
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	count := read(4, countBits)
+	out := make([]byte, count)
+	for i := range out {
+		out[i] = byte(read(4+countBits+8*i, 8))
+	}
+	return out, nil
+}
+
+// qrSyndromesZero evaluates a block at the first ec powers of the generator, which are all roots of a valid block.
+func qrSyndromesZero(block []byte, ec int) bool {
+	var exp [255]byte
+	x := 1
+	for i := range exp {
+		exp[i] = byte(x)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11D
+		}
+	}
+	mul := func(a, b byte) byte {
+		if a == 0 || b == 0 {
+			return 0
+		}
+		var la, lb int
+		for i, e := range exp {
+			if e == a {
+				la = i
+			}
+			if e == b {
+				lb = i
+			}
+		}
+		return exp[(la+lb)%255]
+	}
+	for i := 0; i < ec; i++ {
+		var s byte
+		for _, c := range block {
+			s = mul(s, exp[i]) ^ c
+		}
+		if s != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// HeaderRule sets or removes a header on proxied requests or responses.
+type HeaderRule struct {
+	Name   string
+	Value  string
+	Remove bool
+}
+
+// HeaderRules collects header rules from the command line; it implements flag.Value.
+type HeaderRules []HeaderRule
+
+func (hr *HeaderRules) String() string {
+	if hr == nil {
+		return ""
+	}
+	ss := make([]string, len(*hr))
+	for i, r := range *hr {
+		if r.Remove {
+			ss[i] = "-" + r.Name
+		} else {
+			ss[i] = r.Name + ": " + r.Value
+		}
+	}
+	return strings.Join(ss, ", ")
+}
+
+// Set parses either "Name: value", which replaces any existing header, or "-Name", which removes it.
+func (hr *HeaderRules) Set(arg string) error {
+	if strings.HasPrefix(arg, "-") {
+		*hr = append(*hr, HeaderRule{Name: textproto.CanonicalMIMEHeaderKey(arg[1:]), Remove: true})
+		return nil
+	}
+	i := strings.Index(arg, ":")
+	if i <= 0 {
+		return fmt.Errorf(`expected "Name: value" or "-Name", got %#v`, arg)
+	}
+	name := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(arg[:i]))
+	*hr = append(*hr, HeaderRule{Name: name, Value: strings.TrimSpace(arg[i+1:])})
+	return nil
+}
+
+// Apply applies each rule to h in order.
+func (hr HeaderRules) Apply(h http.Header) {
+	for _, r := range hr {
+		if r.Remove {
+			h.Del(r.Name)
+		} else {
+			h.Set(r.Name, r.Value)
+		}
+	}
+}
+
+// proxied tags outbound proxy requests with the browser's request, so responses can be rewritten for it, and the
+// exchange the inspector is using to record it.
+type proxied struct {
+	in *http.Request
+	id int64
+}
+
+type proxiedKey struct{}
+
+func withProxied(out *http.Request, p *proxied) *http.Request {
+	return out.WithContext(context.WithValue(out.Context(), proxiedKey{}, p))
+}
+
+func proxiedFrom(out *http.Request) *proxied {
+	p, _ := out.Context().Value(proxiedKey{}).(*proxied)
+	if p == nil {
+		return &proxied{id: -1}
+	}
+	return p
+}
+
+// rewriteResponse adjusts a proxied response so the browser treats it as coming from livefire.
+func (f *Forward) rewriteResponse(rsp *http.Response) {
+	in := proxiedFrom(rsp.Request).in
+	if in != nil && cfg.FixLocation {
+		for _, name := range []string{"Location", "Content-Location"} {
+			if loc := rsp.Header.Get(name); loc != "" {
+				rsp.Header.Set(name, f.rewriteLocation(in, rsp.Request.URL, loc))
+			}
+		}
+	}
+	if in != nil && cfg.FixCookies {
+		cookies := rsp.Header["Set-Cookie"]
+		for i, c := range cookies {
+			cookies[i] = f.rewriteCookie(in, c)
+		}
+	}
+	cfg.RspHeaders.Apply(rsp.Header)
+}
+
+// rewriteLocation maps a URL on the upstream back to the same resource behind livefire.  URLs for other hosts are
+// left alone.
+func (f *Forward) rewriteLocation(in *http.Request, out *url.URL, loc string) string {
+	u, err := url.Parse(loc)
+	if err != nil {
+		return loc
+	}
+	u = out.ResolveReference(u)
+	if u.Scheme != out.Scheme || u.Host != out.Host {
+		return loc
+	}
+
+	p := u.Path
+	base := strings.TrimSuffix(f.URL.Path, "/")
+	if base != "" && (p == base || strings.HasPrefix(p, base+"/")) {
+		p = "/" + strings.TrimPrefix(strings.TrimPrefix(p, base), "/")
+	}
+	p = f.unstrip(p)
+	u.Path, u.RawPath = p, ""
+	u.Scheme = requestScheme(in)
+	u.Host = in.Host
+	u.User = nil
+	return u.String()
+}
+
+// rewriteCookie drops the Domain from a Set-Cookie so it lands on livefire's host, drops Secure if the browser is
+// speaking plain HTTP, and puts the prefix back in front of the cookie's path if we strip it.
+func (f *Forward) rewriteCookie(in *http.Request, cookie string) string {
+	secure := in.TLS != nil
+	parts := strings.Split(cookie, ";")
+	out := parts[:1]
+	for _, part := range parts[1:] {
+		attr := strings.TrimSpace(part)
+		key := strings.ToLower(attr)
+		if i := strings.Index(key, "="); i >= 0 {
+			key = strings.TrimSpace(key[:i])
+		}
+		switch key {
+		case "domain":
+			continue
+		case "secure":
+			if !secure {
+				continue
+			}
+		case "samesite":
+			if !secure && strings.HasSuffix(strings.ToLower(attr), "none") {
+				attr = "SameSite=Lax" // browsers reject SameSite=None without Secure.
+			}
+		case "path":
+			i := strings.Index(attr, "=")
+			if i >= 0 {
+				attr = "Path=" + f.unstrip(strings.TrimSpace(attr[i+1:]))
+			}
+		}
+		out = append(out, " "+attr)
+	}
+	return strings.Join(out, ";")
+}
+
+// unstrip puts the prefix back in front of an upstream path if we strip it.  The root maps to the bare prefix, and
+// anything else keeps its trailing slash, since upstreams often redirect "/dir" to "/dir/".
+func (f *Forward) unstrip(p string) string {
+	if !f.Strip || f.Prefix == "/" {
+		return p
+	}
+	if p == "" || p == "/" {
+		return f.Prefix
+	}
+	return f.Prefix + p
+}
+
+func requestScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func testForward(t *testing.T, arg string) *Forward {
+	var fs Forwards
+	if err := fs.Set(arg); err != nil {
+		t.Fatal(err)
+	}
+	return fs[0]
+}
+
+func TestRewriteLocation(t *testing.T) {
+	for _, c := range []struct {
+		fwd, loc, expect string
+	}{
+		{"http://up:9000", "http://up:9000/dir/", "http://lf:8080/dir/"},
+		{"http://up:9000", "/login?next=%2F", "http://lf:8080/login?next=%2F"},
+		{"http://up:9000", "https://elsewhere/", "https://elsewhere/"},
+		{"/api=http://up:9000", "http://up:9000/api/dir/", "http://lf:8080/api/dir/"},
+		{"/api:strip=http://up:9000", "http://up:9000/dir/", "http://lf:8080/api/dir/"},
+		{"/api:strip=http://up:9000", "http://up:9000/dir", "http://lf:8080/api/dir"},
+		{"/api:strip=http://up:9000", "http://up:9000/", "http://lf:8080/api"},
+		{"/api:strip=http://up:9000", "dir/", "http://lf:8080/api/dir/"},
+		{"/api:strip=http://up:9000/v1", "http://up:9000/v1/dir/", "http://lf:8080/api/dir/"},
+		{"/api:strip=http://up:9000/v1", "http://up:9000/v1", "http://lf:8080/api"},
+	} {
+		f := testForward(t, c.fwd)
+		in := httptest.NewRequest("GET", "http://lf:8080/", nil)
+		out, _ := url.Parse("http://up:9000/")
+		got := f.rewriteLocation(in, out, c.loc)
+		if got != c.expect {
+			t.Errorf("%v, %v: got %v, expected %v", c.fwd, c.loc, got, c.expect)
+		}
+	}
+}
+
+func TestRewriteCookie(t *testing.T) {
+	for _, c := range []struct {
+		fwd, cookie, expect string
+	}{
+		{"http://up:9000", "a=1; Domain=up; Path=/dir/; Secure", "a=1; Path=/dir/"},
+		{"http://up:9000", "a=1; SameSite=None; Secure", "a=1; SameSite=Lax"},
+		{"/api=http://up:9000", "a=1; Path=/api/", "a=1; Path=/api/"},
+		{"/api:strip=http://up:9000", "a=1; Path=/dir/", "a=1; Path=/api/dir/"},
+		{"/api:strip=http://up:9000", "a=1; Path=/dir", "a=1; Path=/api/dir"},
+		{"/api:strip=http://up:9000", "a=1; path=/; HttpOnly", "a=1; Path=/api; HttpOnly"},
+	} {
+		f := testForward(t, c.fwd)
+		in := httptest.NewRequest("GET", "http://lf:8080/", nil)
+		got := f.rewriteCookie(in, c.cookie)
+		if got != c.expect {
+			t.Errorf("%v, %v: got %v, expected %v", c.fwd, c.cookie, got, c.expect)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	tarantula "github.com/swdunlop/tarantula-go"
+)
+
+// Server wraps a tarantula.Service with what livefire needs that tarantula doesn't offer: listeners other than TCP,
+// a guard in front of every route, and a list of the routes that have been bound.
+type Server struct {
+	*tarantula.Service
+	addr     string
+	listen   func(addr string) (net.Listener, error)
+	guard    tarantula.Func
+	listener net.Listener
+	mu       sync.Mutex
+	routes   []string
+}
+
+// NewServer creates a Server that will listen on addr once started; see listen.
+func NewServer(addr string) *Server {
+	return &Server{Service: tarantula.NewService(addr), addr: addr, listen: listen}
+}
+
+// SetListen replaces how Start creates the server's listener, which is listen(addr) by default.
+func (srv *Server) SetListen(fn func(addr string) (net.Listener, error)) {
+	srv.listen = fn
+}
+
+// Guard installs a function that sees every request before it is routed; if the guard returns a response or an
+// error, that is sent instead, and the request goes no further.
+func (srv *Server) Guard(fn tarantula.Func) {
+	srv.guard = fn
+}
+
+// Bind binds fn to pattern, like tarantula.Service.Bind, and remembers the route.
+func (srv *Server) Bind(pattern string, fn tarantula.Func) {
+	srv.Service.Bind(pattern, fn)
+	srv.addRoute(pattern)
+}
+
+// BindRedirect redirects pattern to dest, like tarantula.Service.BindRedirect, and remembers the route.
+func (srv *Server) BindRedirect(pattern string, dest string) {
+	srv.Service.BindRedirect(pattern, dest)
+	srv.addRoute(pattern)
+}
+
+func (srv *Server) addRoute(pattern string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.routes = append(srv.routes, pattern)
+}
+
+// Routes lists the patterns bound to the server, in the order they were bound.
+func (srv *Server) Routes() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]string{}, srv.routes...)
+}
+
+// ServeHTTP passes requests the guard allows on to the service.
+func (srv *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if srv.guard != nil {
+		val, err := srv.guard(req)
+		if val != nil || err != nil {
+			err = tarantula.RespondToHttp(rw, val, err)
+			if err != nil {
+				log.Println(req.RemoteAddr, "response error", err.Error())
+			}
+			return
+		}
+	}
+	srv.Service.ServeHTTP(rw, req)
+}
+
+// Start creates the server's listener, but does not accept requests; see Run.
+func (srv *Server) Start() error {
+	if srv.listener != nil {
+		return nil
+	}
+	l, err := srv.listen(srv.addr)
+	if err != nil {
+		return err
+	}
+	srv.listener = l
+	return nil
+}
+
+// Addr returns the address the server is listening on once it has been started, or nil before then.
+func (srv *Server) Addr() net.Addr {
+	if srv.listener == nil {
+		return nil
+	}
+	return srv.listener.Addr()
+}
+
+// stopTimeout limits how long Run waits for pending requests once it has been asked to stop; long polls and event
+// streams would otherwise hold it up.
+const stopTimeout = 5 * time.Second
+
+// Run serves requests until the listener fails or one of the stopSignals arrives.  Like tarantula, a signal stops
+// the server accepting connections and lets pending requests finish before Run returns.  The listener is closed
+// either way, which removes a unix socket file.
+func (srv *Server) Run() error {
+	err := srv.Start()
+	if err != nil {
+		return err
+	}
+	defer srv.listener.Close()
+	hs := &http.Server{Handler: srv}
+	stopped := make(chan struct{})
+	go srv.handleSignals(hs, stopped)
+	err = hs.Serve(srv.listener)
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-stopped
+	return nil
+}
+
+// handleSignals shuts hs down when one of the stopSignals arrives, then closes stopped.  A second signal gets the
+// default behavior, for when the pending requests are taking too long.
+func (srv *Server) handleSignals(hs *http.Server, stopped chan struct{}) {
+	defer close(stopped)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, stopSignals...)
+	sig := <-signals
+	signal.Stop(signals)
+	log.Println("stopping after", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	if err := hs.Shutdown(ctx); err != nil {
+		hs.Close()
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// stopSignals ask a running Server to stop; SIGUSR1 is what tarantula used.
+var stopSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGINT, syscall.SIGTERM}
@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// stopSignals ask a running Server to stop; windows only has interrupts.
+var stopSignals = []os.Signal{os.Interrupt}
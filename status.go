@@ -0,0 +1,618 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tarantula "github.com/swdunlop/tarantula-go"
+)
+
+// Session tracks what livefire serves and watches while it runs, so /.livefire/status can describe it and change
+// it.
+type Session struct {
+	mu       sync.Mutex
+	svc      *Server
+	stalker  *Stalker
+	files    []string               // served files, in the order they were added
+	served   map[string]string      // files served at their own route, by route
+	bound    map[string]bool        // routes bound for files, which outlive their files
+	watched  map[string][]time.Time // recent changes to each watched file, by absolute path
+	modes    map[string]string      // watch modes of served files that have one, by absolute path
+	paused   bool
+	missed   bool // something changed while paused
+	browsers int
+	clients  map[string]*Client
+	errors   []SessionError
+	seq      int64 // bumped whenever anything above changes
+	updated  chan struct{}
+}
+
+// Client is a page running the shim, as seen through its waits; each page load is a new client.
+type Client struct {
+	ID        string    `json:"id"`
+	Connected time.Time `json:"connected"`
+	Addr      string    `json:"addr"`
+	UserAgent string    `json:"userAgent"`
+	Page      string    `json:"page"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Waiting   bool      `json:"waiting"`
+}
+
+// SessionError is a problem livefire ran into, kept for /.livefire/status.
+type SessionError struct {
+	Time  time.Time `json:"time"`
+	What  string    `json:"what"`
+	Error string    `json:"error"`
+}
+
+// sessionErrorLimit is how many recent errors are kept.
+const sessionErrorLimit = 50
+
+// changeHistoryLimit is how many changes are kept for each watched file.
+const changeHistoryLimit = 20
+
+// clientTimeout is how long a browser that isn't waiting is remembered.
+const clientTimeout = 30 * time.Second
+
+var session = &Session{
+	served:  make(map[string]string),
+	bound:   make(map[string]bool),
+	watched: make(map[string][]time.Time),
+	modes:   make(map[string]string),
+	clients: make(map[string]*Client),
+	updated: make(chan struct{}),
+}
+
+// Reload asks processBrowsers to reload some browsers, or every browser if Clients is nil.
+type Reload struct {
+	Reason  string
+	Clients []string
+}
+
+var reloads = make(chan Reload, 16)
+
+// reportError logs err and keeps it for /.livefire/status.
+func reportError(what string, err error) {
+	log.Println(what, err.Error())
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.errors = append(session.errors, SessionError{time.Now(), what, err.Error()})
+	if len(session.errors) > sessionErrorLimit {
+		session.errors = append([]SessionError{}, session.errors[len(session.errors)-sessionErrorLimit:]...)
+	}
+	session.touch()
+}
+
+// touch wakes anyone waiting for the session to change; ss.mu must be held.
+func (ss *Session) touch() {
+	ss.seq++
+	close(ss.updated)
+	ss.updated = make(chan struct{})
+}
+
+// Watch starts watching paths for changes, which will be reported on the returned channel.
+func (ss *Session) Watch(paths ...string) (chan string, error) {
+	stalker, err := Stalk(paths...)
+	if err != nil {
+		return nil, err
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.stalker = stalker
+	for _, p := range paths {
+		p, err = filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		ss.watched[p] = nil
+	}
+	return stalker.C, nil
+}
+
+// Watch modes, given as a suffix on files on the command line, like "data.json:nowatch".
+const (
+	watchNone   = "nowatch"     // the file is served, but changes are ignored
+	watchNotify = "notify-only" // changes are sent to pages as a livefire:change event instead of reloading them
+)
+
+// splitWatchMode separates a watch mode from the end of arg; only known modes are split off, so other colons are
+// left alone.
+func splitWatchMode(arg string) (string, string) {
+	i := strings.LastIndex(arg, ":")
+	if i < 0 {
+		return arg, ""
+	}
+	switch mode := arg[i+1:]; mode {
+	case watchNone, watchNotify:
+		return arg[:i], mode
+	}
+	return arg, ""
+}
+
+// setWatchMode notes how changes to file should be handled.
+func (ss *Session) setWatchMode(file, mode string) {
+	abs, _ := filepath.Abs(file)
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if mode == "" {
+		delete(ss.modes, abs)
+	} else {
+		ss.modes[abs] = mode
+	}
+}
+
+// WatchedFiles lists the files being served that should be watched.
+func (ss *Session) WatchedFiles() []string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var files []string
+	for _, f := range ss.files {
+		if abs, _ := filepath.Abs(f); ss.modes[abs] != watchNone {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// Files lists the files being served.
+func (ss *Session) Files() []string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return append([]string{}, ss.files...)
+}
+
+// Served finds the file served at route, if any.
+func (ss *Session) Served(route string) (string, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	file, ok := ss.served[route]
+	return file, ok
+}
+
+// serve notes that file is served at route, and reports whether the route must still be bound; it fails if
+// something other than a file already has the route.
+func (ss *Session) serve(file, route string) (bool, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if f, ok := ss.served[route]; ok {
+		return false, fmt.Errorf(`%v is already serving %v`, route, f)
+	}
+	bound := ss.bound[route]
+	if !bound && ss.svc != nil {
+		for _, r := range ss.svc.Routes() {
+			if r == route {
+				return false, fmt.Errorf(`%v is already routed`, route)
+			}
+		}
+	}
+	ss.served[route] = file
+	ss.bound[route] = true
+	return !bound, nil
+}
+
+// What browsers should do about a change, according to changed.
+const (
+	ignoreChange = iota
+	reloadChange
+	notifyChange
+)
+
+// changed records a change to path, and says what browsers should do about it.
+func (ss *Session) changed(path string) int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if history, ok := ss.watched[path]; ok {
+		history = append(history, time.Now())
+		if len(history) > changeHistoryLimit {
+			history = append([]time.Time{}, history[len(history)-changeHistoryLimit:]...)
+		}
+		ss.watched[path] = history
+	}
+	ss.touch()
+	switch {
+	case ss.modes[path] == watchNone:
+		return ignoreChange
+	case ss.modes[path] == watchNotify:
+		if ss.paused {
+			return ignoreChange
+		}
+		return notifyChange
+	case ss.paused:
+		ss.missed = true
+		return ignoreChange
+	}
+	return reloadChange
+}
+
+// changeEvent describes a change to path for the shim, which dispatches it as a livefire:change event, then reloads
+// if reload is set and the page did not prevent it.  Files embedded in the page are reported at /index.html, and
+// files that aren't served, like mocks, have no URL.
+func (ss *Session) changeEvent(path string, reload bool) MirrorEvent {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ev := struct {
+		Type   string `json:"type"`
+		Path   string `json:"path"`
+		URL    string `json:"url,omitempty"`
+		Reload bool   `json:"reload,omitempty"`
+	}{"change", path, "", reload}
+	for _, f := range ss.files {
+		if abs, _ := filepath.Abs(f); abs == path {
+			ev.Path = filepath.ToSlash(f)
+			ev.URL = "/index.html"
+		}
+	}
+	for route, f := range ss.served {
+		if abs, _ := filepath.Abs(f); abs == path {
+			ev.URL = route
+		}
+	}
+	data, _ := json.Marshal(ev)
+	return MirrorEvent{Data: data}
+}
+
+func (ss *Session) setBrowsers(n int) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.browsers != n {
+		ss.browsers = n
+		ss.touch()
+	}
+}
+
+// seen notes that client is waiting in req.
+func (ss *Session) seen(id string, req *http.Request) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	c := ss.clients[id]
+	if c == nil {
+		c = &Client{ID: id, Connected: time.Now()}
+		ss.clients[id] = c
+	}
+	c.Addr, c.UserAgent, c.Page = req.RemoteAddr, req.UserAgent(), req.Referer()
+	c.LastSeen, c.Waiting = time.Now(), true
+	ss.touch()
+}
+
+// left notes that client is no longer waiting.  A client whose wait was answered is remembered for a while, since it
+// will be back unless it is reloading; one that hung up on its wait is gone.
+func (ss *Session) left(id string, answered bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	c := ss.clients[id]
+	switch {
+	case c == nil:
+		return
+	case answered:
+		c.LastSeen, c.Waiting = time.Now(), false
+	default:
+		delete(ss.clients, id)
+	}
+	ss.touch()
+}
+
+// matchClients finds the clients that match all of the "client", "page" and "agent" filters in q; a client matches a
+// filter if it matches any value given for it.  Pages match by path prefix, and agents by a case-insensitive
+// substring.
+func (ss *Session) matchClients(q url.Values) []string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ids := []string{}
+	for id, c := range ss.clients {
+		page := c.Page
+		if u, err := url.Parse(c.Page); err == nil {
+			page = u.Path
+		}
+		if matchAny(q["client"], func(v string) bool { return v == id }) &&
+			matchAny(q["page"], func(v string) bool { return strings.HasPrefix(page, v) }) &&
+			matchAny(q["agent"], func(v string) bool {
+				return strings.Contains(strings.ToLower(c.UserAgent), strings.ToLower(v))
+			}) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// matchAny reports whether fn accepts any of vals, or true if there are no vals.
+func matchAny(vals []string, fn func(string) bool) bool {
+	for _, v := range vals {
+		if fn(v) {
+			return true
+		}
+	}
+	return len(vals) == 0
+}
+
+// newClientID picks an ID for a page load.
+func newClientID() string {
+	return randomToken()[:16]
+}
+
+// prune forgets clients that left a while ago; ss.mu must be held.
+func (ss *Session) prune() {
+	for id, c := range ss.clients {
+		if !c.Waiting && time.Since(c.LastSeen) > clientTimeout {
+			delete(ss.clients, id)
+		}
+	}
+}
+
+// addFile starts serving and watching file while livefire is running; like the command line, file may end with a
+// watch mode.
+func (ss *Session) addFile(file string) error {
+	file, mode := splitWatchMode(file)
+	file = filepath.Clean(file)
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	if !inWorkingDir(abs) {
+		return fmt.Errorf(`%v is outside the working directory`, file)
+	}
+	ss.mu.Lock()
+	_, dup := ss.watched[abs]
+	for _, f := range ss.files {
+		if a, _ := filepath.Abs(f); a == abs {
+			dup = true
+		}
+	}
+	svc := ss.svc
+	ss.mu.Unlock()
+	if dup {
+		return fmt.Errorf(`%v is already being served`, file)
+	}
+	err = bindFile(svc, file)
+	if err != nil {
+		return err
+	}
+	ss.setWatchMode(file, mode)
+	if mode == watchNone {
+		return nil
+	}
+	err = ss.stalker.Follow(abs)
+	if err != nil {
+		return err
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.watched[abs] = nil
+	ss.touch()
+	return nil
+}
+
+// inWorkingDir reports whether path is beneath the working directory, even after following symlinks, so
+// /.livefire/status/files can't be used to read anything else.
+func inWorkingDir(path string) bool {
+	wd, err := os.Getwd()
+	if err != nil {
+		return false
+	}
+	beneath := func(dir, p string) bool {
+		rel, err := filepath.Rel(dir, p)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	ok := beneath(wd, path)
+	if real, err := filepath.EvalSymlinks(path); ok && err == nil {
+		realWd, err := filepath.EvalSymlinks(wd)
+		ok = err == nil && beneath(realWd, real)
+	}
+	return ok
+}
+
+// removeFile stops serving and watching file; its route answers 404 until the file is added again.
+func (ss *Session) removeFile(file string) error {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	found := false
+	kept := ss.files[:0]
+	for _, f := range ss.files {
+		if a, _ := filepath.Abs(f); a == abs {
+			found = true
+			continue
+		}
+		kept = append(kept, f)
+	}
+	ss.files = kept
+	delete(ss.modes, abs)
+	for route, f := range ss.served {
+		if a, _ := filepath.Abs(f); a == abs {
+			delete(ss.served, route)
+		}
+	}
+	if _, ok := ss.watched[abs]; ok {
+		found = true
+		delete(ss.watched, abs)
+	}
+	if !found {
+		return fmt.Errorf(`%v is not being served`, file)
+	}
+	ss.touch()
+	return ss.stalker.Unfollow(abs)
+}
+
+// setPaused pauses or resumes reloading browsers when files change; resuming reloads them if anything changed in
+// the meantime.
+func (ss *Session) setPaused(paused bool) {
+	ss.mu.Lock()
+	missed := ss.missed && !paused
+	ss.paused = paused
+	ss.missed = false
+	ss.touch()
+	ss.mu.Unlock()
+	if missed {
+		requestReload("files changed while paused")
+	}
+}
+
+// requestReload reloads the given clients, or every browser if none are given.
+func requestReload(reason string, clients ...string) {
+	reloads <- Reload{reason, clients}
+}
+
+type sessionStatus struct {
+	Seq      int64           `json:"seq"`
+	Routes   []string        `json:"routes"`
+	Files    []string        `json:"files"`
+	Watched  []watchedStatus `json:"watched"`
+	Paused   bool            `json:"paused"`
+	Browsers int             `json:"browsers"`
+	Clients  []*Client       `json:"clients"`
+	Forwards []forwardStatus `json:"forwards"`
+	Errors   []SessionError  `json:"errors"`
+}
+
+type watchedStatus struct {
+	Path    string      `json:"path"`
+	Mode    string      `json:"mode,omitempty"`
+	Changed *time.Time  `json:"changed,omitempty"`
+	History []time.Time `json:"history"`
+}
+
+type forwardStatus struct {
+	Prefix string `json:"prefix"`
+	URL    string `json:"url"`
+	Strip  bool   `json:"strip,omitempty"`
+}
+
+func (ss *Session) status() sessionStatus {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.prune()
+	st := sessionStatus{
+		Seq:      ss.seq,
+		Clients:  []*Client{},
+		Files:    append([]string{}, ss.files...),
+		Watched:  []watchedStatus{},
+		Paused:   ss.paused,
+		Browsers: ss.browsers,
+		Forwards: []forwardStatus{},
+		Errors:   append([]SessionError{}, ss.errors...),
+	}
+	if ss.svc != nil {
+		st.Routes = ss.svc.Routes()
+	}
+	for p, history := range ss.watched {
+		ws := watchedStatus{Path: p, Mode: ss.modes[p], History: append([]time.Time{}, history...)}
+		if len(history) > 0 {
+			ws.Changed = &ws.History[len(history)-1]
+		}
+		st.Watched = append(st.Watched, ws)
+	}
+	for _, c := range ss.clients {
+		c := *c
+		st.Clients = append(st.Clients, &c)
+	}
+	sort.Slice(st.Clients, func(i, j int) bool { return st.Clients[i].ID < st.Clients[j].ID })
+	sort.Slice(st.Watched, func(i, j int) bool { return st.Watched[i].Path < st.Watched[j].Path })
+	for _, f := range cfg.Fwd {
+		st.Forwards = append(st.Forwards, forwardStatus{f.Prefix, f.URL.String(), f.Strip})
+	}
+	return st
+}
+
+// Since waits up to timeout for the session to change after seq, or for req to be abandoned.
+func (ss *Session) Since(req *http.Request, seq int64, timeout time.Duration) {
+	ss.mu.Lock()
+	cur, updated := ss.seq, ss.updated
+	ss.mu.Unlock()
+	if cur > seq {
+		return
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	select {
+	case <-updated:
+	case <-deadline.C:
+	case <-req.Context().Done():
+	}
+}
+
+// presentStatus answers /.livefire/status with what livefire is serving, watching and forwarding; with ?since=SEQ,
+// it waits for something newer than SEQ.
+func presentStatus(req *http.Request) (interface{}, error) {
+	if s := req.URL.Query().Get("since"); s != "" {
+		since, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, tarantula.HttpError{Code: 400, Msg: err.Error()}
+		}
+		session.Since(req, since, 25*time.Second)
+	}
+	return session.status(), nil
+}
+
+// controlReload answers a POST to /.livefire/status/reload by reloading every browser, or just the ones matching
+// "client", "page" and "agent" in the query.
+func controlReload(req *http.Request) (interface{}, error) {
+	if req.Method != "POST" {
+		return nil, tarantula.HttpError{Code: 405, Msg: "expected a POST"}
+	}
+	q := req.URL.Query()
+	if len(q["client"])+len(q["page"])+len(q["agent"]) == 0 {
+		requestReload("asked to through /.livefire/status/reload")
+		return session.status(), nil
+	}
+	ids := session.matchClients(q)
+	if len(ids) == 0 {
+		return nil, tarantula.HttpError{Code: 404, Msg: "no browsers match"}
+	}
+	requestReload("asked to through /.livefire/status/reload", ids...)
+	return session.status(), nil
+}
+
+// controlWatch answers a POST to /.livefire/status/watch?paused=1 or 0 by pausing or resuming reloads.
+func controlWatch(req *http.Request) (interface{}, error) {
+	if req.Method != "POST" {
+		return nil, tarantula.HttpError{Code: 405, Msg: "expected a POST"}
+	}
+	paused, err := strconv.ParseBool(req.URL.Query().Get("paused"))
+	if err != nil {
+		return nil, tarantula.HttpError{Code: 400, Msg: `expected "paused" to be 1 or 0`}
+	}
+	session.setPaused(paused)
+	log.Printf("reloading is now paused: %v", paused)
+	return session.status(), nil
+}
+
+// controlFiles answers a POST to /.livefire/status/files?add=PATH&remove=PATH by serving and watching new files, or
+// forgetting old ones; both may be repeated.
+func controlFiles(req *http.Request) (interface{}, error) {
+	if req.Method != "POST" {
+		return nil, tarantula.HttpError{Code: 405, Msg: "expected a POST"}
+	}
+	q := req.URL.Query()
+	for _, file := range q["remove"] {
+		err := session.removeFile(file)
+		if err != nil {
+			log.Println("cannot remove", file, err.Error())
+			return nil, tarantula.HttpError{Code: 400, Msg: err.Error()}
+		}
+		log.Printf("no longer serving %#v", file)
+	}
+	for _, file := range q["add"] {
+		err := session.addFile(file)
+		if err != nil {
+			log.Println("cannot add", file, err.Error())
+			return nil, tarantula.HttpError{Code: 400, Msg: err.Error()}
+		}
+	}
+	if len(q["add"])+len(q["remove"]) > 0 {
+		requestReload("files were added or removed")
+	}
+	return session.status(), nil
+}
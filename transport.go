@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Upstream collects options for how livefire connects to the services behind -r.
+type Upstream struct {
+	CA         string        // PEM bundle of extra CAs to trust
+	Cert       string        // PEM client certificate
+	Key        string        // PEM client key, defaults to Cert
+	Insecure   bool          // skip verifying the upstream's certificate
+	ServerName string        // overrides the name sent in SNI and checked in the certificate
+	Timeout    time.Duration // for connecting and waiting for response headers
+	Proxy      string        // http, https or socks5 proxy URL; defaults to the environment
+}
+
+// Check refuses a ServerName that would apply to more than one TLS forward in fs, since every forward shares the
+// transport, and each upstream would be expected to present a certificate for the same name.
+func (up *Upstream) Check(fs Forwards) error {
+	if up.ServerName == "" {
+		return nil
+	}
+	var secure []string
+	for _, f := range fs {
+		if f.URL.Scheme == "https" || f.URL.Scheme == "wss" {
+			secure = append(secure, f.String())
+		}
+	}
+	if len(secure) > 1 {
+		return fmt.Errorf(`-r-server-name would apply to every TLS forward, not just one: %v`, strings.Join(secure, " "))
+	}
+	return nil
+}
+
+// Transport builds the http.Transport described by up.
+func (up *Upstream) Transport() (*http.Transport, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tc := &tls.Config{
+		InsecureSkipVerify: up.Insecure,
+		ServerName:         up.ServerName,
+	}
+
+	if up.CA != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(up.CA)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf(`no certificates found in %v`, up.CA)
+		}
+		tc.RootCAs = pool
+	}
+
+	if up.Cert != "" {
+		key := up.Key
+		if key == "" {
+			key = up.Cert
+		}
+		cert, err := tls.LoadX509KeyPair(up.Cert, key)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	} else if up.Key != "" {
+		return nil, fmt.Errorf(`a client key needs a client certificate`)
+	}
+	tr.TLSClientConfig = tc
+
+	if up.Proxy != "" {
+		u, err := url.Parse(up.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf(`cannot use %#v as a proxy; expected http, https or socks5`, up.Proxy)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+
+	if up.Timeout > 0 {
+		tr.DialContext = (&net.Dialer{Timeout: up.Timeout, KeepAlive: 30 * time.Second}).DialContext
+		tr.TLSHandshakeTimeout = up.Timeout
+		tr.ResponseHeaderTimeout = up.Timeout
+	}
+	return tr, nil
+}
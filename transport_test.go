@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestUpstreamCheckServerName(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		fwds  []string
+		valid bool
+	}{
+		{"", []string{"https://a", "/b=https://b"}, true},
+		{"api.internal", []string{"https://a"}, true},
+		{"api.internal", []string{"https://a", "/ws=ws://b", "/plain=http://c"}, true},
+		{"api.internal", []string{"https://a", "/auth=https://b"}, false},
+		{"api.internal", []string{"/api=https://a", "/ws=wss://a"}, false},
+	} {
+		var fs Forwards
+		for _, arg := range c.fwds {
+			if err := fs.Set(arg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		up := Upstream{ServerName: c.name}
+		err := up.Check(fs)
+		if (err == nil) != c.valid {
+			t.Errorf("%v with %v: got %v", c.name, c.fwds, err)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// parseYAML understands enough YAML for fixture files: block mappings and sequences, plain and quoted scalars,
+// literal and folded block scalars, comments, and JSON-style flow collections.  Anchors, tags and multiple
+// documents are not supported.
+func parseYAML(data []byte) (interface{}, error) {
+	yp := &yamlParser{}
+	for i, raw := range strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n") {
+		yp.lines = append(yp.lines, yamlLine{no: i + 1, raw: raw})
+	}
+	yp.prepare()
+	yp.skipBlank()
+	if yp.done() {
+		return nil, nil
+	}
+	v, err := yp.node(yp.lines[yp.pos].indent)
+	if err != nil {
+		return nil, err
+	}
+	yp.skipBlank()
+	if !yp.done() {
+		return nil, yp.errorf("unexpected content")
+	}
+	return v, nil
+}
+
+type yamlLine struct {
+	no     int
+	raw    string
+	indent int
+	text   string // without indentation or comments; empty for blank lines
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (yp *yamlParser) prepare() {
+	for i := range yp.lines {
+		ln := &yp.lines[i]
+		trimmed := strings.TrimLeft(ln.raw, " ")
+		ln.indent = len(ln.raw) - len(trimmed)
+		ln.text = strings.TrimSpace(stripYAMLComment(trimmed))
+		if ln.text == "---" && ln.indent == 0 {
+			ln.text = ""
+		}
+	}
+}
+
+// stripYAMLComment removes a trailing "# comment" that is not inside quotes.
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func (yp *yamlParser) done() bool { return yp.pos >= len(yp.lines) }
+
+func (yp *yamlParser) skipBlank() {
+	for !yp.done() && yp.lines[yp.pos].text == "" {
+		yp.pos++
+	}
+}
+
+func (yp *yamlParser) errorf(format string, args ...interface{}) error {
+	no := len(yp.lines)
+	if !yp.done() {
+		no = yp.lines[yp.pos].no
+	}
+	return fmt.Errorf("yaml line %v: %v", no, fmt.Sprintf(format, args...))
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// node parses whatever starts at the current line, which must be indented by indent.
+func (yp *yamlParser) node(indent int) (interface{}, error) {
+	ln := yp.lines[yp.pos]
+	switch {
+	case isSeqItem(ln.text):
+		return yp.sequence(indent)
+	case mappingKey(ln.text) >= 0:
+		return yp.mapping(indent)
+	}
+	yp.pos++
+	return yamlScalar(ln.text)
+}
+
+func (yp *yamlParser) sequence(indent int) (interface{}, error) {
+	seq := []interface{}{}
+	for {
+		yp.skipBlank()
+		if yp.done() {
+			break
+		}
+		ln := &yp.lines[yp.pos]
+		if ln.indent != indent || !isSeqItem(ln.text) {
+			break
+		}
+		rest := strings.TrimPrefix(ln.text[1:], " ")
+		if strings.TrimSpace(rest) == "" {
+			yp.pos++
+			v, err := yp.child(indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+		// treat "- key: value" as if the item's content started its own line.
+		offset := len(ln.text) - len(strings.TrimLeft(ln.text[1:], " "))
+		ln.indent += offset
+		ln.text = strings.TrimSpace(rest)
+		v, err := yp.node(ln.indent)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+	}
+	return seq, nil
+}
+
+// child parses the value nested below a line at indent, or returns nil if nothing is nested.
+func (yp *yamlParser) child(indent int) (interface{}, error) {
+	yp.skipBlank()
+	if yp.done() {
+		return nil, nil
+	}
+	ln := yp.lines[yp.pos]
+	if ln.indent > indent {
+		return yp.node(ln.indent)
+	}
+	return nil, nil
+}
+
+// mappingKey returns the index of the colon ending a mapping key in text, or -1.
+func mappingKey(text string) int {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && i == 0:
+			quote = c
+		case c == '{' || c == '[':
+			if i == 0 {
+				return -1 // flow collection
+			}
+		case c == ':':
+			if i+1 == len(text) || text[i+1] == ' ' {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func (yp *yamlParser) mapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for {
+		yp.skipBlank()
+		if yp.done() {
+			break
+		}
+		ln := yp.lines[yp.pos]
+		if ln.indent != indent || isSeqItem(ln.text) {
+			break
+		}
+		i := mappingKey(ln.text)
+		if i < 0 {
+			return nil, yp.errorf("expected a mapping key")
+		}
+		key, err := yamlScalar(strings.TrimSpace(ln.text[:i]))
+		if err != nil {
+			return nil, err
+		}
+		k := fmt.Sprint(key)
+		if key == nil {
+			k = "null"
+		}
+		val := strings.TrimSpace(ln.text[i+1:])
+		yp.pos++
+
+		switch {
+		case val == "":
+			yp.skipBlank()
+			if !yp.done() && yp.lines[yp.pos].indent == indent && isSeqItem(yp.lines[yp.pos].text) {
+				m[k], err = yp.sequence(indent)
+			} else {
+				m[k], err = yp.child(indent)
+			}
+		case val[0] == '|' || val[0] == '>':
+			m[k] = yp.block(indent, val)
+		default:
+			m[k], err = yamlScalar(val)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// block gathers a literal (|) or folded (>) block scalar nested below a line at indent.
+func (yp *yamlParser) block(indent int, header string) string {
+	var lines []string
+	blockIndent := -1
+	for ; !yp.done(); yp.pos++ {
+		ln := yp.lines[yp.pos]
+		if strings.TrimSpace(ln.raw) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		if ln.indent <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = ln.indent
+		}
+		if ln.indent < blockIndent {
+			break
+		}
+		lines = append(lines, ln.raw[blockIndent:])
+	}
+
+	// trailing blank lines belong to whatever comes next, unless we keep them.
+	end := len(lines)
+	for end > 0 && lines[end-1] == "" {
+		end--
+	}
+	trailing := lines[end:]
+	lines = lines[:end]
+
+	var s string
+	if header[0] == '|' {
+		s = strings.Join(lines, "\n")
+	} else {
+		var parts []string
+		para := ""
+		for _, l := range lines {
+			switch {
+			case l == "":
+				parts = append(parts, para)
+				para = ""
+			case para == "":
+				para = l
+			default:
+				para += " " + l
+			}
+		}
+		s = strings.Join(append(parts, para), "\n")
+	}
+
+	switch {
+	case strings.Contains(header, "-"):
+	case strings.Contains(header, "+"):
+		s += "\n" + strings.Repeat("\n", len(trailing))
+	default:
+		if len(lines) > 0 {
+			s += "\n"
+		}
+	}
+	return s
+}
+
+// yamlScalar interprets a single line scalar or flow collection.
+func yamlScalar(s string) (interface{}, error) {
+	switch {
+	case s == "":
+		return nil, nil
+	case s[0] == '"':
+		return strconv.Unquote(s)
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, fmt.Errorf("unterminated string %v", s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case s[0] == '[' || s[0] == '{':
+		var v interface{}
+		err := json.Unmarshal([]byte(s), &v)
+		if err != nil {
+			return nil, fmt.Errorf("flow collections must be valid JSON: %v", err)
+		}
+		return v, nil
+	}
+
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	// numbers follow YAML 1.2's core schema, so 010 is ten, and 1_000 or inf are strings.
+	switch {
+	case yamlInt.MatchString(s):
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+	case strings.HasPrefix(s, "0x"):
+		if i, err := strconv.ParseInt(s[2:], 16, 64); err == nil {
+			return i, nil
+		}
+	case strings.HasPrefix(s, "0o"):
+		if i, err := strconv.ParseInt(s[2:], 8, 64); err == nil {
+			return i, nil
+		}
+	}
+	if yamlFloat.MatchString(s) {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f, nil
+		}
+	}
+	return s, nil
+}
+
+var (
+	yamlInt   = regexp.MustCompile(`^[-+]?[0-9]+$`)
+	yamlFloat = regexp.MustCompile(`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+)
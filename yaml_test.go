@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type yamlMap = map[string]interface{}
+type yamlSeq = []interface{}
+
+func TestParseYAML(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		src  string
+		out  interface{}
+	}{
+		{"help text", `
+- method: GET
+  path: /api/users/*
+  status: 200
+  headers: {"X-Mocked": "yes"}
+  file: fixtures/user.json
+  delay: 250ms
+- path: /api/health
+  body: {"ok": true}
+`, yamlSeq{
+			yamlMap{"method": "GET", "path": "/api/users/*", "status": int64(200),
+				"headers": yamlMap{"X-Mocked": "yes"}, "file": "fixtures/user.json", "delay": "250ms"},
+			yamlMap{"path": "/api/health", "body": yamlMap{"ok": true}},
+		}},
+		{"scalars", `
+int: 42
+negative: -7
+leading zero: 010
+octal: 0o17
+hex: 0x1f
+underscore: 1_000
+float: 2.5
+exponent: 1e3
+inf: inf
+yes: true
+no: FALSE
+nothing: ~
+empty:
+single: 'it''s'
+double: "tab\there"
+`, yamlMap{
+			"int": int64(42), "negative": int64(-7), "leading zero": int64(10), "octal": int64(15),
+			"hex": int64(31), "underscore": "1_000", "float": 2.5, "exponent": 1000.0, "inf": "inf",
+			"yes": true, "no": false, "nothing": nil, "empty": nil, "single": "it's", "double": "tab\there",
+		}},
+		{"block scalars", `
+literal: |
+  line one
+    indented
+  line three
+
+folded: >
+  one
+  two
+
+  three
+strip: |-
+  no newline
+keep: |+
+  kept
+
+after: done
+`, yamlMap{
+			"literal": "line one\n  indented\nline three\n",
+			"folded":  "one two\nthree\n",
+			"strip":   "no newline",
+			"keep":    "kept\n\n",
+			"after":   "done",
+		}},
+		{"nested sequences", `
+matrix:
+  - - 1
+    - 2
+  -
+    - a
+    - b
+items:
+- name: x
+  tags:
+    - red
+    - blue
+- name: y
+  tags: []
+`, yamlMap{
+			"matrix": yamlSeq{yamlSeq{int64(1), int64(2)}, yamlSeq{"a", "b"}},
+			"items": yamlSeq{
+				yamlMap{"name": "x", "tags": yamlSeq{"red", "blue"}},
+				yamlMap{"name": "y", "tags": yamlSeq{}},
+			},
+		}},
+		{"quoted comments", `
+# a comment
+---
+hash: "a # not a comment" # but this is
+single: 'b # nor this'
+url: http://example.com/#anchor
+plain: c # comment
+`, yamlMap{
+			"hash":   "a # not a comment",
+			"single": "b # nor this",
+			"url":    "http://example.com/#anchor",
+			"plain":  "c",
+		}},
+		{"empty", "# nothing here\n", nil},
+	} {
+		out, err := parseYAML([]byte(c.src))
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, c.out) {
+			t.Errorf("%v: got %#v, expected %#v", c.name, out, c.out)
+		}
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	for _, src := range []string{
+		"a: 1\n  b: 2\n",
+		"key: 'unterminated\n",
+		"key: [1, 2\n",
+		"- a\nb: c\n",
+	} {
+		_, err := parseYAML([]byte(src))
+		if err == nil {
+			t.Errorf("expected an error from %q", strings.TrimSpace(src))
+		}
+	}
+}